@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/akupila/gitprompt"
+)
+
+// cacheVersion changes when the status is stored differently, so that files
+// written by an older version are not used.
+const cacheVersion = 4
+
+// cacheSource gets the status from src and keeps it in a file per repository
+// in dir. The status is reused until the index, HEAD, a tracked file or a
+// directory containing one is modified, or a ref it depends on moves.
+//
+// Files added in directories without tracked files, such as a new file in a
+// new directory, are not noticed until something else changes.
+type cacheSource struct {
+	// dir is the directory the cache files are kept in.
+	dir string
+	// repoDir is the directory to get the status for.
+	repoDir string
+	// options are the settings that change the status, such as the
+	// untracked mode. The status is not reused if they differ.
+	options string
+	src     gitprompt.StatusSource
+}
+
+// cacheKey is the state of the repository the status was read in.
+type cacheKey struct {
+	Version  int    `json:"version"`
+	Options  string `json:"options"`
+	Index    int64  `json:"index"`
+	Head     int64  `json:"head"`
+	WorkTree string `json:"worktree"`
+	// Refs is the state of HEAD, the upstream and the stash, which commits,
+	// resets, fetches and pushes change without touching the files above.
+	Refs string `json:"refs"`
+}
+
+type cacheFile struct {
+	Key    cacheKey             `json:"key"`
+	Status *gitprompt.GitStatus `json:"status"`
+}
+
+// defaultCacheDir returns $XDG_CACHE_HOME/gitprompt, or ~/.cache/gitprompt if
+// XDG_CACHE_HOME is not set.
+func defaultCacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "gitprompt")
+}
+
+// Status implements gitprompt.StatusSource.
+func (c cacheSource) Status(ctx context.Context) (*gitprompt.GitStatus, error) {
+	workTree, gitDir, err := gitprompt.RepoPaths(c.repoDir)
+	if workTree == "" || err != nil {
+		// Not a repository, or one the source has to make sense of.
+		return c.src.Status(ctx)
+	}
+
+	// The key is read before the status, so that a change made while the
+	// status is read makes the cached status stale. Neither source writes
+	// the index, git status runs with GIT_OPTIONAL_LOCKS=0.
+	key, err := c.key(workTree, gitDir)
+	if err != nil {
+		return c.src.Status(ctx)
+	}
+	file := filepath.Join(c.dir, cacheName(workTree))
+	if cached, err := readCache(file); err == nil && cached.Key == key {
+		return cached.Status, nil
+	}
+
+	s, err := c.src.Status(ctx)
+	if s == nil || s.TimedOut || err != nil {
+		return s, err
+	}
+	_ = writeCache(file, cacheFile{Key: key, Status: s})
+	return s, nil
+}
+
+// key returns the current state of the repository.
+func (c cacheSource) key(workTree, gitDir string) (cacheKey, error) {
+	refs, err := gitprompt.RefState(workTree)
+	if err != nil {
+		return cacheKey{}, err
+	}
+	files, err := gitprompt.WorkTreeState(workTree)
+	if err != nil {
+		return cacheKey{}, err
+	}
+	return cacheKey{
+		Version:  cacheVersion,
+		Options:  c.options,
+		Index:    modTime(filepath.Join(gitDir, "index")),
+		Head:     modTime(filepath.Join(gitDir, "HEAD")),
+		WorkTree: files,
+		Refs:     refs,
+	}, nil
+}
+
+// modTime returns the modification time of the file in nanoseconds, or 0 if
+// it doesn't exist.
+func modTime(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.ModTime().UnixNano()
+}
+
+// cacheName returns the name of the cache file for the working tree.
+func cacheName(workTree string) string {
+	sum := sha1.Sum([]byte(workTree))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+func readCache(file string) (*cacheFile, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c cacheFile
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// writeCache writes the cache file through a temporary file, so that a prompt
+// in another terminal never reads it half written.
+func writeCache(file string, c cacheFile) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
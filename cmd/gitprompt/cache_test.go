@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akupila/gitprompt"
+)
+
+// emptyIndex is an index file without entries.
+const emptyIndex = "DIRC\x00\x00\x00\x02\x00\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+func TestCacheSource(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gitprompt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	for _, dir := range []string{filepath.Join(repo, ".git"), filepath.Join(repo, "sub")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, ".git", "HEAD"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, ".git", "index"), []byte(emptyIndex), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	var fail error
+	src := gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+		calls++
+		if fail != nil {
+			return nil, fail
+		}
+		return &gitprompt.GitStatus{Branch: "master", Modified: calls}, nil
+	})
+	cache := cacheSource{dir: filepath.Join(tmp, "cache"), repoDir: filepath.Join(repo, "sub"), options: "a", src: src}
+
+	// Modification times are set explicitly, as the file system may not
+	// notice changes made quickly one after another.
+	modified := time.Now()
+	touch := func(path string) {
+		t.Helper()
+		modified = modified.Add(time.Second)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func(c cacheSource, expected int) {
+		t.Helper()
+		s, err := c.Status(context.Background())
+		if err != nil {
+			t.Fatalf("Received unexpected error: %v", err)
+		}
+		if s.Branch != "master" || s.Modified != expected {
+			t.Errorf("Expected status from call %d, got %+v", expected, s)
+		}
+		if calls != expected {
+			t.Errorf("Expected %d calls, got %d", expected, calls)
+		}
+	}
+
+	status(cache, 1)
+	status(cache, 1)
+	touch(filepath.Join(repo, ".git", "index"))
+	status(cache, 2)
+	status(cache, 2)
+	touch(filepath.Join(repo, ".git", "HEAD"))
+	status(cache, 3)
+	touch(repo)
+	status(cache, 4)
+	status(cache, 4)
+
+	other := cache
+	other.options = "b"
+	status(other, 5)
+	status(cache, 6)
+
+	touch(repo)
+	fail = errors.New("failed")
+	if _, err := cache.Status(context.Background()); err != fail {
+		t.Errorf("Expected error, got %v", err)
+	}
+	fail = nil
+	status(cache, 8)
+}
+
+func TestCacheSourceNotRepository(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gitprompt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cacheDir := filepath.Join(tmp, "cache")
+	cache := cacheSource{
+		dir:     cacheDir,
+		repoDir: tmp,
+		src: gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+			return nil, nil
+		}),
+	}
+	s, err := cache.Status(context.Background())
+	if s != nil || err != nil {
+		t.Errorf("Expected no status, got %v, %v", s, err)
+	}
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be cached, got %v", err)
+	}
+}
+
+func TestCacheSourceRefs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gitprompt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	writeFile := func(name, content string) {
+		t.Helper()
+		file := filepath.Join(repo, ".git", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// Only the content changes, not the modification time.
+		fi, statErr := os.Stat(file)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if statErr == nil {
+			if err := os.Chtimes(file, fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeFile("HEAD", "ref: refs/heads/master\n")
+	writeFile("index", emptyIndex)
+	writeFile("config", "[branch \"master\"]\n\tremote = origin\n\tmerge = refs/heads/master\n")
+	writeFile("refs/heads/master", "1111111111111111111111111111111111111111\n")
+	writeFile("refs/remotes/origin/master", "1111111111111111111111111111111111111111\n")
+
+	calls := 0
+	cache := cacheSource{
+		dir:     filepath.Join(tmp, "cache"),
+		repoDir: repo,
+		src: gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+			calls++
+			return &gitprompt.GitStatus{Branch: "master", Ahead: calls}, nil
+		}),
+	}
+	status := func(expected int) {
+		t.Helper()
+		s, err := cache.Status(context.Background())
+		if err != nil {
+			t.Fatalf("Received unexpected error: %v", err)
+		}
+		if s.Ahead != expected || calls != expected {
+			t.Errorf("Expected status from call %d, got %d after %d calls", expected, s.Ahead, calls)
+		}
+	}
+
+	status(1)
+	status(1)
+	// A push or fetch moves the upstream.
+	writeFile("refs/remotes/origin/master", "2222222222222222222222222222222222222222\n")
+	status(2)
+	// A commit or reset --soft moves the branch.
+	writeFile("refs/heads/master", "3333333333333333333333333333333333333333\n")
+	status(3)
+	status(3)
+	writeFile("refs/stash", "4444444444444444444444444444444444444444\n")
+	writeFile("logs/refs/stash", "x\n")
+	status(4)
+	// Dropping an older stash only changes the log.
+	writeFile("logs/refs/stash", "x\ny\n")
+	status(5)
+	status(5)
+}
+
+func TestCacheSourceWorkTree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gitprompt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	run := func(commands string) {
+		t.Helper()
+		cmd := exec.Command("bash", "-c", "set -e\n"+commands)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Setup command failed: %v\n%s", err, out)
+		}
+	}
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	run(`
+		git init
+		mkdir sub
+		echo a > f
+		echo a > sub/g
+		git add f sub/g
+		git commit -m 'first'
+	`)
+
+	cache := cacheSource{
+		dir:     filepath.Join(tmp, "cache"),
+		repoDir: repo,
+		src:     gitprompt.ExecSource{Dir: repo},
+	}
+	status := func(modified, untracked int) {
+		t.Helper()
+		s, err := cache.Status(context.Background())
+		if err != nil {
+			t.Fatalf("Received unexpected error: %v", err)
+		}
+		if s.Modified != modified || s.Untracked != untracked {
+			t.Errorf("Expected %d modified and %d untracked, got %d and %d", modified, untracked, s.Modified, s.Untracked)
+		}
+	}
+
+	status(0, 0)
+	status(0, 0)
+	// Edits change the size too, so they're noticed even if the file system
+	// doesn't move the modification time.
+	run("echo b >> f")
+	status(1, 0)
+	status(1, 0)
+	run("echo b >> sub/g")
+	status(2, 0)
+	run("touch sub/h")
+	status(2, 1)
+	run("rm f")
+	status(2, 1)
+	run("git checkout f")
+	status(1, 1)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/akupila/gitprompt"
+	"github.com/akupila/gitprompt/internal/gitconfig"
+)
+
+// configKeys are the flags that can be set in the config file.
+var configKeys = []string{"format", "shell", "timeout", "native", "untracked", "separator", "thin-separator", "cache"}
+
+// configSection is a section of a config file that sets flags.
+type configSection struct {
+	// file is the config file, name is the name of the section in it.
+	file string
+	name string
+	get  func(key string) (string, bool)
+	// repo is set for the repository's git config, which takes precedence
+	// over GITPROMPT_FORMAT.
+	repo bool
+}
+
+// fileSection returns the section of the config file.
+func fileSection(file string, cfg *gitconfig.Config, name string) configSection {
+	return configSection{
+		file: file,
+		name: name,
+		get: func(key string) (string, bool) {
+			return cfg.Get(name + "." + key)
+		},
+	}
+}
+
+// repoSection returns the gitprompt section of the repository's git config.
+func repoSection(values map[string]string) configSection {
+	return configSection{
+		file: "git config",
+		name: "gitprompt",
+		get: func(key string) (string, bool) {
+			v, ok := values[key]
+			return v, ok
+		},
+		repo: true,
+	}
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/gitprompt/config, or
+// ~/.config/gitprompt/config if XDG_CONFIG_HOME is not set.
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "gitprompt", "config")
+}
+
+// loadConfig reads the gitprompt section of the git config of the repository
+// dir is in and the config file at path, and sets the flags that were not set
+// on the command line from them. Returns true if gitprompt is disabled in the
+// repository.
+func loadConfig(path, profile, dir string) (bool, error) {
+	var sections []configSection
+	repo, err := gitprompt.RepoConfig(dir)
+	if err != nil {
+		return false, err
+	}
+	if repo != nil {
+		sections = append(sections, repoSection(repo))
+	}
+
+	if profile == "" {
+		profile = os.Getenv("GITPROMPT_PROFILE")
+	}
+	if profile == "" {
+		profile = repo["profile"]
+	}
+	if path != "" {
+		cfg, err := gitconfig.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		s, err := configSections(path, cfg, profile, dir)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", path, err)
+		}
+		sections = append(sections, s...)
+	}
+
+	if err := applyConfig(flag.CommandLine, sections); err != nil {
+		return false, err
+	}
+	return disabled(sections)
+}
+
+// disabled returns true if the first section that sets disabled sets it to
+// true.
+func disabled(sections []configSection) (bool, error) {
+	for _, s := range sections {
+		v, ok := s.get("disabled")
+		if !ok {
+			continue
+		}
+		b, ok := gitconfig.ParseBool(v)
+		if !ok {
+			return false, fmt.Errorf("%s: %s.disabled: invalid boolean %q", s.file, s.name, v)
+		}
+		return b, nil
+	}
+	return false, nil
+}
+
+// configSections returns the sections of the config file that apply in dir,
+// highest precedence first: the [repo "path"] section with the longest path
+// that contains dir, the profile and [gitprompt].
+//
+// If profile is empty, the profile set in the repo section or in [gitprompt]
+// is used, if any.
+func configSections(file string, cfg *gitconfig.Config, profile, dir string) ([]configSection, error) {
+	var sections []configSection
+	repo := matchRepo(cfg, dir)
+	if repo != "" {
+		sections = append(sections, fileSection(file, cfg, "repo."+repo))
+		if profile == "" {
+			profile, _ = cfg.Get("repo." + repo + ".profile")
+		}
+	}
+	if profile == "" {
+		profile, _ = cfg.Get("gitprompt.profile")
+	}
+	if profile != "" {
+		if !contains(cfg.Subsections("profile"), profile) {
+			return nil, fmt.Errorf("unknown profile %q", profile)
+		}
+		sections = append(sections, fileSection(file, cfg, "profile."+profile))
+	}
+	return append(sections, fileSection(file, cfg, "gitprompt")), nil
+}
+
+// matchRepo returns the path of the [repo "path"] section that contains dir.
+// If several do, the longest one is returned.
+func matchRepo(cfg *gitconfig.Config, dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	match, matchLen := "", -1
+	for _, repo := range cfg.Subsections("repo") {
+		p := filepath.Clean(expandHome(repo))
+		if !filepath.IsAbs(p) || !within(abs, p) {
+			continue
+		}
+		if len(p) > matchLen {
+			match, matchLen = repo, len(p)
+		}
+	}
+	return match
+}
+
+// within returns true if path is dir or inside it.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// applyConfig sets the flags in configKeys that were not set on the command
+// line from the first section that has them. If GITPROMPT_FORMAT is set, the
+// format is only set from the repository's git config.
+func applyConfig(fs *flag.FlagSet, sections []configSection) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	env := os.Getenv("GITPROMPT_FORMAT") != ""
+	for _, key := range configKeys {
+		if set[key] {
+			continue
+		}
+		for _, s := range sections {
+			if key == "format" && env && !s.repo {
+				continue
+			}
+			v, ok := s.get(key)
+			if !ok {
+				continue
+			}
+			if key == "format" && v == "" {
+				// An unquoted # or ; starts a comment.
+				return fmt.Errorf("%s: %s.format: empty format, formats starting with # must be quoted", s.file, s.name)
+			}
+			if err := fs.Set(key, v); err != nil {
+				return fmt.Errorf("%s: %s.%s: %v", s.file, s.name, key, err)
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akupila/gitprompt"
+	"github.com/akupila/gitprompt/internal/gitconfig"
+)
+
+const testConfig = `
+[gitprompt]
+	format = "base"
+	timeout = 100ms
+	separator = ">"
+[profile "minimal"]
+	format = "minimal"
+	native
+[profile "powerline"]
+	format = "powerline"
+	shell = zsh
+[repo "/src/monorepo"]
+	profile = minimal
+	timeout = 50ms
+[repo "/src"]
+	format = "src"
+[repo "/src/monorepo/vendor"]
+	format = "vendor"
+	profile = powerline
+`
+
+func TestConfigSections(t *testing.T) {
+	cfg, err := gitconfig.Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		profile  string
+		dir      string
+		expected []string
+	}{
+		{"no repo", "", "/home", []string{"gitprompt"}},
+		{"profile", "powerline", "/home", []string{"profile.powerline", "gitprompt"}},
+		{"repo", "", "/src/other", []string{"repo./src", "gitprompt"}},
+		{"repo profile", "", "/src/monorepo", []string{"repo./src/monorepo", "profile.minimal", "gitprompt"}},
+		{"repo subdir", "", "/src/monorepo/cmd", []string{"repo./src/monorepo", "profile.minimal", "gitprompt"}},
+		{"flag profile", "powerline", "/src/monorepo", []string{"repo./src/monorepo", "profile.powerline", "gitprompt"}},
+		{"longest repo", "", "/src/monorepo/vendor/x", []string{"repo./src/monorepo/vendor", "profile.powerline", "gitprompt"}},
+		{"prefix", "", "/src/monorepo2", []string{"repo./src", "gitprompt"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sections, err := configSections("config", cfg, test.profile, test.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, s := range sections {
+				names = append(names, s.name)
+			}
+			if strings.Join(names, " ") != strings.Join(test.expected, " ") {
+				t.Errorf("Expected %q, got %q", test.expected, names)
+			}
+		})
+	}
+
+	if _, err := configSections("config", cfg, "missing", "/home"); err == nil {
+		t.Errorf("Expected error for unknown profile")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	cfg, err := gitconfig.Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		args      []string
+		env       string
+		dir       string
+		format    string
+		timeout   time.Duration
+		native    bool
+		separator string
+	}{
+		{name: "base", dir: "/home", format: "base", timeout: 100 * time.Millisecond, separator: ">"},
+		{name: "repo", dir: "/src/monorepo", format: "minimal", timeout: 50 * time.Millisecond, native: true, separator: ">"},
+		{name: "env", dir: "/src/monorepo", env: "env", format: "env", timeout: 50 * time.Millisecond, native: true, separator: ">"},
+		{name: "flag", args: []string{"-format=flag", "-timeout=1s"}, env: "env", dir: "/src/monorepo", format: "flag", timeout: time.Second, native: true, separator: ">"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer os.Setenv("GITPROMPT_FORMAT", os.Getenv("GITPROMPT_FORMAT"))
+			os.Setenv("GITPROMPT_FORMAT", test.env)
+
+			var format formatFlag
+			fs := flag.NewFlagSet("gitprompt", flag.ContinueOnError)
+			fs.Var(&format, "format", "")
+			shell := fs.String("shell", "", "")
+			timeout := fs.Duration("timeout", 0, "")
+			native := fs.Bool("native", false, "")
+			separator := fs.String("separator", "", "")
+			fs.String("thin-separator", "", "")
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			sections, err := configSections("config", cfg, "", test.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := applyConfig(fs, sections); err != nil {
+				t.Fatal(err)
+			}
+
+			if format.String() != test.format {
+				t.Errorf("Expected format %q, got %q", test.format, format.String())
+			}
+			if *shell != "" {
+				t.Errorf("Expected no shell, got %q", *shell)
+			}
+			if *timeout != test.timeout {
+				t.Errorf("Expected timeout %v, got %v", test.timeout, *timeout)
+			}
+			if *native != test.native {
+				t.Errorf("Expected native %v, got %v", test.native, *native)
+			}
+			if *separator != test.separator {
+				t.Errorf("Expected separator %q, got %q", test.separator, *separator)
+			}
+		})
+	}
+}
+
+func TestApplyConfigError(t *testing.T) {
+	cfg, err := gitconfig.Parse(strings.NewReader("[gitprompt]\n\ttimeout = soon\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("gitprompt", flag.ContinueOnError)
+	fs.Duration("timeout", 0, "")
+	err = applyConfig(fs, []configSection{fileSection("config", cfg, "gitprompt")})
+	if err == nil || !strings.HasPrefix(err.Error(), "config: gitprompt.timeout: ") {
+		t.Errorf("Expected error for invalid timeout, got %v", err)
+	}
+
+	defer os.Setenv("GITPROMPT_FORMAT", os.Getenv("GITPROMPT_FORMAT"))
+	os.Setenv("GITPROMPT_FORMAT", "")
+	cfg, err = gitconfig.Parse(strings.NewReader("[gitprompt]\n\tformat = #r%h [%a]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var format formatFlag
+	fs = flag.NewFlagSet("gitprompt", flag.ContinueOnError)
+	fs.Var(&format, "format", "")
+	err = applyConfig(fs, []configSection{fileSection("config", cfg, "gitprompt")})
+	if err == nil || !strings.HasPrefix(err.Error(), "config: gitprompt.format: empty format") {
+		t.Errorf("Expected error for unquoted format, got %v", err)
+	}
+}
+
+func TestRepoSection(t *testing.T) {
+	cfg, err := gitconfig.Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections, err := configSections("config", cfg, "", "/src/monorepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := repoSection(map[string]string{"format": "git config", "untracked": "no"})
+	sections = append([]configSection{repo}, sections...)
+
+	defer os.Setenv("GITPROMPT_FORMAT", os.Getenv("GITPROMPT_FORMAT"))
+	os.Setenv("GITPROMPT_FORMAT", "")
+
+	var format formatFlag
+	var untracked gitprompt.UntrackedMode
+	fs := flag.NewFlagSet("gitprompt", flag.ContinueOnError)
+	fs.Var(&format, "format", "")
+	fs.Var(&untracked, "untracked", "")
+	timeout := fs.Duration("timeout", 0, "")
+	fs.Bool("native", false, "")
+	fs.String("separator", "", "")
+	if err := applyConfig(fs, sections); err != nil {
+		t.Fatal(err)
+	}
+	if format.String() != "git config" {
+		t.Errorf("Expected format from git config, got %q", format.String())
+	}
+	if untracked != gitprompt.UntrackedNo {
+		t.Errorf("Expected untracked mode from git config, got %q", untracked.String())
+	}
+	if *timeout != 50*time.Millisecond {
+		t.Errorf("Expected timeout from the config file, got %v", *timeout)
+	}
+}
+
+func TestRepoSectionEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		repo     map[string]string
+		expected string
+	}{
+		{name: "repo over env", repo: map[string]string{"format": "git config"}, expected: "git config"},
+		{name: "env over file", repo: map[string]string{}, expected: "env"},
+		{name: "flag over repo", args: []string{"-format=flag"}, repo: map[string]string{"format": "git config"}, expected: "flag"},
+	}
+
+	cfg, err := gitconfig.Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("GITPROMPT_FORMAT", os.Getenv("GITPROMPT_FORMAT"))
+	os.Setenv("GITPROMPT_FORMAT", "env")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sections, err := configSections("config", cfg, "", "/src/monorepo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sections = append([]configSection{repoSection(test.repo)}, sections...)
+
+			var format formatFlag
+			fs := flag.NewFlagSet("gitprompt", flag.ContinueOnError)
+			fs.Var(&format, "format", "")
+			fs.Duration("timeout", 0, "")
+			fs.Bool("native", false, "")
+			fs.String("separator", "", "")
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyConfig(fs, sections); err != nil {
+				t.Fatal(err)
+			}
+			if format.String() != test.expected {
+				t.Errorf("Expected format %q, got %q", test.expected, format.String())
+			}
+		})
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		sections []configSection
+		expected bool
+		err      bool
+	}{
+		{name: "unset", sections: []configSection{repoSection(nil)}},
+		{name: "true", sections: []configSection{repoSection(map[string]string{"disabled": "true"})}, expected: true},
+		{name: "first wins", sections: []configSection{
+			repoSection(map[string]string{"disabled": "no"}),
+			repoSection(map[string]string{"disabled": "yes"}),
+		}},
+		{name: "invalid", sections: []configSection{repoSection(map[string]string{"disabled": "maybe"})}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := disabled(test.sections)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
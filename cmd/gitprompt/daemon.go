@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/akupila/gitprompt/internal/daemon"
+)
+
+// runDaemon parses the flags of the daemon subcommand and serves the status
+// of repositories on the socket until the process is interrupted. socket is
+// the path given to -socket before the subcommand, if any.
+func runDaemon(args []string, socket string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	fs.StringVar(&socket, "socket", socket, "Listen on `path`")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("daemon: unexpected argument %q", fs.Arg(0))
+	}
+
+	l, err := daemon.Listen(socket)
+	if err != nil {
+		return err
+	}
+
+	srv := &daemon.Server{}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		_ = srv.Close()
+	}()
+	return srv.Serve(l)
+}
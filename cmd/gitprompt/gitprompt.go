@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 
 	"github.com/akupila/gitprompt"
+	"github.com/akupila/gitprompt/internal/daemon"
 )
 
 var (
@@ -15,7 +18,7 @@ var (
 	goversion = "unknown"
 )
 
-const defaultFormat = "#B([@b#R%h][#y ›%s][#m ↓%b][#m ↑%a][#r x%c][#g +%m][#y %u]#B) "
+const defaultFormat = "#B([@b#R%h][#Y %o[ %p]][#y ›%s][#m ↓%b][#m ↑%a][#r x%c][#g +%m][#y %u][#K …%t]#B) "
 
 type formatFlag struct {
 	set   bool
@@ -51,6 +54,8 @@ var exampleStatus = &gitprompt.GitStatus{
 	Conflicts: 4,
 	Ahead:     5,
 	Behind:    6,
+	Stashes:   7,
+	Upstream:  "origin/master",
 }
 
 var formatHelp = func() string {
@@ -68,6 +73,25 @@ Data:
 	%%c	Number of conflicts
 	%%m	Number of files modified
 	%%u	Number of untracked files
+	%%S	Number of stashes
+	%%o	Operation in progress, such as REBASE or MERGE
+	%%p	Progress of a rebase or am, such as 3/7
+	%%r	Upstream branch, such as origin/master
+	%%g	Nothing; shows the group if the upstream branch is gone
+	%%t	Nothing; shows the group if -timeout was reached
+
+Clean or dirty working tree:
+	%%{clean}	Nothing; shows the group if nothing has changed
+	%%{dirty}	Nothing; shows the group if anything has changed
+	%%{changed}	Number of changed files
+
+Files staged and modified by kind of change:
+	%%{index.modified}	%%{worktree.modified}
+	%%{index.added}	%%{worktree.added}
+	%%{index.deleted}	%%{worktree.deleted}
+	%%{index.renamed}	%%{worktree.renamed}
+	%%{index.copied}	%%{worktree.copied}
+	%%{index.typechanged}	%%{worktree.typechanged}
 
 Colors:
 	#k	Black
@@ -86,6 +110,24 @@ Colors:
 	#M	Highlight Magenta
 	#C	Highlight Cyan
 	#W	Highlight White
+	#{n}	Color n of the 256-color palette, 0-255
+	#{rrggbb}	24-bit color in hex, such as #{ff8800}
+
+Background colors:
+	#^k ... #^W	Same colors as above, such as #^b for blue
+	#^{n}	Color n of the 256-color palette, 0-255
+	#^{rrggbb}	24-bit color in hex
+	#^_	Reset background color
+
+Conditional groups:
+	[?{cond} a|b]	Print a if cond is true, b otherwise
+	[? a|b]	Print a if it has data with a value, b otherwise
+	Conditions use names such as behind, the operators ! == != < <= > >= && ||
+	and parentheses, for example [?{behind > 10}#r↓%%b]
+
+Segments:
+	#[	Start segment
+	]	End segment
 
 Text attributes:
 	@b	Set bold
@@ -93,13 +135,43 @@ Text attributes:
 	@f	Set faint/dim color
 	@F	Clear faint/dim color
 	@i	Set italic
-	@I	Clear italic`, defaultFormat, example)
+	@I	Clear italic
+	@u	Set underline
+	@U	Clear underline
+	@{style}	Set underline style: single, double, curly, dotted or dashed
+	@k	Set blink
+	@K	Clear blink
+	@r	Set reverse video
+	@R	Clear reverse video
+	@s	Set strikethrough
+	@S	Clear strikethrough
+	@o	Set overline
+	@O	Clear overline
+	@_	Clear all attributes`, defaultFormat, example)
 }
 
 func main() {
 	v := flag.Bool("version", false, "Print version inforformation.")
-	zsh := flag.Bool("zsh", false, "Print zsh width control characters")
+	zsh := flag.Bool("zsh", false, "Print the width for zsh's %G after the output, for use inside %{ %}. Prefer -shell=zsh")
+	native := flag.Bool("native", false, "Read the repository directly instead of running git status")
+	var dir string
+	flag.StringVar(&dir, "C", "", "Get the status of the repository in `dir` instead of the current directory")
+	flag.StringVar(&dir, "dir", "", "Same as -C")
+	timeout := flag.Duration("timeout", 0, "Only print the branch if getting the status takes longer than `duration`, such as 200ms")
+	var printer gitprompt.Printer
+	flag.StringVar(&printer.Separator, "separator", gitprompt.DefaultSeparator, "Print `glyph` between segments with different backgrounds")
+	flag.StringVar(&printer.ThinSeparator, "thin-separator", gitprompt.DefaultThinSeparator, "Print `glyph` between segments with the same background")
+	flag.Var(&printer.Shell, "shell", "Wrap escape codes for `shell`: zsh, bash, readline, fish or plain")
+	var untracked gitprompt.UntrackedMode
+	flag.Var(&untracked, "untracked", "Find untracked files in `mode` no, normal or all, like git status --untracked-files")
 	flag.Var(&format, "format", formatHelp())
+	checkFormat := flag.Bool("check-format", false, "Check the format for errors and exit without printing the status")
+	configFile := flag.String("config", defaultConfigPath(), "Read settings from the config `file`")
+	profile := flag.String("profile", "", "Use the settings of the profile `name` in the config file. Defaults to $GITPROMPT_PROFILE")
+	socket := flag.String("socket", daemon.DefaultSocket(), "Ask the daemon started with gitprompt daemon listening on `path` for the status")
+	noDaemon := flag.Bool("no-daemon", false, "Don't ask the daemon for the status")
+	printJSON := flag.Bool("json", false, "Print the status as JSON instead of formatting it")
+	useCache := flag.Bool("cache", false, "Reuse the status cached in $XDG_CACHE_HOME/gitprompt until the repository changes")
 	flag.Parse()
 
 	if *v {
@@ -110,15 +182,86 @@ func main() {
 		os.Exit(0)
 	}
 
-	s, err := gitprompt.Parse()
+	if flag.Arg(0) == "daemon" {
+		// Flags after the subcommand are the daemon's own.
+		if err := runDaemon(flag.Args()[1:], *socket); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	disabled, err := loadConfig(*configFile, *profile, dir)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *checkFormat {
+		if _, err := gitprompt.Compile(format.String()); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			if ferr, ok := err.(*gitprompt.FormatError); ok {
+				_, _ = fmt.Fprintln(os.Stderr, ferr.Caret())
+			}
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if disabled {
+		return
+	}
+
+	var source gitprompt.StatusSource = gitprompt.ExecSource{Dir: dir, Untracked: untracked}
+	if *native {
+		source = gitprompt.NativeSource{Dir: dir, Untracked: untracked}
+	}
+	if cacheDir := defaultCacheDir(); *useCache && cacheDir != "" {
+		source = cacheSource{
+			dir:     cacheDir,
+			repoDir: dir,
+			options: fmt.Sprintf("native=%t untracked=%s", *native, untracked.String()),
+			src:     source,
+		}
+	}
+	if !*noDaemon {
+		source = daemon.Source{
+			Socket:   *socket,
+			Request:  daemon.Request{Dir: dir, Native: *native, Untracked: untracked},
+			Fallback: source,
+		}
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	s, err := gitprompt.ParseContext(ctx, source)
+	if err == context.DeadlineExceeded {
+		s, err = gitprompt.ParseHead(dir)
+		if s != nil {
+			s.TimedOut = true
+		}
+	}
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if *printJSON {
+		// Prints null outside a repository.
+		b, err := json.Marshal(s)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "%s\n", b)
+		return
+	}
 	if s == nil {
 		return
 	}
-	out, num := gitprompt.Print(s, format.String())
+	out, num := printer.Print(s, format.String())
 	_, _ = fmt.Fprint(os.Stdout, out)
 	if *zsh {
 		_, _ = fmt.Fprintf(os.Stdout, "%%%dG", num)
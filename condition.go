@@ -0,0 +1,230 @@
+package gitprompt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// condition is a parsed condition of a conditional group, such as
+// behind > 10 && !conflicts. Values are integers, true is 1 and false is 0.
+//
+// From highest to lowest precedence, the operators are:
+//
+//	!                   not
+//	== != < <= > >=     comparison
+//	&&                  and
+//	||                  or
+//
+// Parentheses group expressions.
+type condition interface {
+	eval(s *GitStatus) int
+}
+
+type (
+	condNumber int
+	condValue  func(s *GitStatus) int
+	condNot    struct{ x condition }
+	condBinary struct {
+		op   string
+		x, y condition
+	}
+)
+
+func (n condNumber) eval(s *GitStatus) int { return int(n) }
+
+func (v condValue) eval(s *GitStatus) int { return v(s) }
+
+func (n condNot) eval(s *GitStatus) int { return boolInt(n.x.eval(s) == 0) }
+
+func (b condBinary) eval(s *GitStatus) int {
+	switch b.op {
+	case "&&":
+		return boolInt(b.x.eval(s) != 0 && b.y.eval(s) != 0)
+	case "||":
+		return boolInt(b.x.eval(s) != 0 || b.y.eval(s) != 0)
+	}
+	x, y := b.x.eval(s), b.y.eval(s)
+	switch b.op {
+	case "==":
+		return boolInt(x == y)
+	case "!=":
+		return boolInt(x != y)
+	case "<":
+		return boolInt(x < y)
+	case "<=":
+		return boolInt(x <= y)
+	case ">":
+		return boolInt(x > y)
+	case ">=":
+		return boolInt(x >= y)
+	}
+	panic("unknown operator " + b.op)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseCondition parses the condition in a [?{condition} ...] group.
+func parseCondition(src string) (condition, error) {
+	p := &conditionParser{src: src}
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return c, nil
+}
+
+type conditionParser struct {
+	src string
+	pos int
+}
+
+// conditionError is an error in a condition at the byte offset pos.
+type conditionError struct {
+	src    string
+	pos    int
+	reason string
+}
+
+func (e *conditionError) Error() string {
+	return fmt.Sprintf("condition %q: %s", e.src, e.reason)
+}
+
+func (p *conditionParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.pos, format, args...)
+}
+
+func (p *conditionParser) errorAt(pos int, format string, args ...interface{}) error {
+	return &conditionError{src: p.src, pos: pos, reason: fmt.Sprintf(format, args...)}
+}
+
+func (p *conditionParser) space() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// accept consumes the operator if it's next.
+func (p *conditionParser) accept(op string) bool {
+	p.space()
+	if strings.HasPrefix(p.src[p.pos:], op) {
+		p.pos += len(op)
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) or() (condition, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = condBinary{op: "||", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *conditionParser) and() (condition, error) {
+	x, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		y, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		x = condBinary{op: "&&", x: x, y: y}
+	}
+	return x, nil
+}
+
+// comparisonOps are the comparison operators, longest first so <= is not
+// read as <.
+var comparisonOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func (p *conditionParser) comparison() (condition, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range comparisonOps {
+		if p.accept(op) {
+			y, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return condBinary{op: op, x: x, y: y}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *conditionParser) unary() (condition, error) {
+	// != is handled as a comparison, so only a single ! is not.
+	if p.accept("!") {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return condNot{x}, nil
+	}
+	return p.primary()
+}
+
+func (p *conditionParser) primary() (condition, error) {
+	p.space()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end")
+	}
+	if p.accept("(") {
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("missing )")
+		}
+		return x, nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+		p.pos++
+	}
+	word := p.src[start:p.pos]
+	if word == "" {
+		return nil, p.errorf("unexpected %q", p.src[start:])
+	}
+	if isDigits(word) {
+		n, err := strconv.Atoi(word)
+		if err != nil {
+			return nil, p.errorAt(start, "invalid number %s", word)
+		}
+		return condNumber(n), nil
+	}
+	if v, ok := values[word]; ok {
+		return condValue(v), nil
+	}
+	if f, ok := flags[word]; ok {
+		return condValue(func(s *GitStatus) int { return boolInt(f(s)) }), nil
+	}
+	return nil, p.errorAt(start, "unknown name %s", word)
+}
+
+func isNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_'
+}
@@ -0,0 +1,60 @@
+package gitprompt
+
+import "testing"
+
+func TestParseCondition(t *testing.T) {
+	s := &GitStatus{Staged: 2, Modified: 1, Behind: 12, Upstream: "origin/master"}
+	tests := []struct {
+		src      string
+		expected int
+	}{
+		{"staged", 2},
+		{"untracked", 0},
+		{"42", 42},
+		{"!staged", 0},
+		{"!!staged", 1},
+		{"staged == 2", 1},
+		{"staged != 2", 0},
+		{"behind > 10", 1},
+		{"behind >= 12", 1},
+		{"behind < 12", 0},
+		{"behind <= 12", 1},
+		{"upstream && !gone", 1},
+		{"staged && untracked || modified", 1},
+		{"staged && (untracked || modified)", 1},
+		{"untracked || staged && !modified", 0},
+		{"(untracked || staged) && !modified", 0},
+		{"!(staged > 5)", 1},
+		{" staged==2&&modified==1 ", 1},
+		{"index.added == 0", 1},
+	}
+	for _, test := range tests {
+		c, err := parseCondition(test.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.src, err)
+			continue
+		}
+		if actual := c.eval(s); actual != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.src, test.expected, actual)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"nope",
+		"staged >",
+		"staged > > 1",
+		"(staged",
+		"staged)",
+		"staged = 1",
+		"staged & modified",
+		"1 < 2 < 3",
+		"99999999999999999999",
+	} {
+		if _, err := parseCondition(src); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
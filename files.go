@@ -0,0 +1,123 @@
+package gitprompt
+
+import "fmt"
+
+// FileStatus is the status of a single changed file.
+type FileStatus struct {
+	// Path is the path of the file, relative to the root of the working
+	// tree. Untracked directories end with a slash.
+	Path string `json:"path"`
+	// OrigPath is the path the file was renamed or copied from.
+	OrigPath string `json:"orig_path"`
+	// Index is the state of the file in the index compared to HEAD, and
+	// Worktree the state in the working tree compared to the index.
+	Index    FileState `json:"index"`
+	Worktree FileState `json:"worktree"`
+	// Submodule is set if the file is a submodule.
+	Submodule bool `json:"submodule"`
+	// Conflict is the kind of merge conflict, if the file is unmerged.
+	Conflict ConflictType `json:"conflict"`
+}
+
+// FileState is the state of a file, using the same letters as git status
+// --short.
+type FileState byte
+
+// File states.
+const (
+	StateUnmodified  FileState = '.'
+	StateModified    FileState = 'M'
+	StateTypeChanged FileState = 'T'
+	StateAdded       FileState = 'A'
+	StateDeleted     FileState = 'D'
+	StateRenamed     FileState = 'R'
+	StateCopied      FileState = 'C'
+	StateUnmerged    FileState = 'U'
+	StateUntracked   FileState = '?'
+	StateIgnored     FileState = '!'
+)
+
+func (s FileState) String() string {
+	return string(s)
+}
+
+// MarshalText encodes the state as its letter, so FileStatus is encoded as
+// JSON with "M" rather than 77.
+func (s FileState) MarshalText() ([]byte, error) {
+	return []byte{byte(s)}, nil
+}
+
+// UnmarshalText decodes the state from its letter.
+func (s *FileState) UnmarshalText(text []byte) error {
+	if len(text) != 1 {
+		return fmt.Errorf("invalid file state %q", text)
+	}
+	*s = FileState(text[0])
+	return nil
+}
+
+// ConflictType is the kind of merge conflict, describing which sides of the
+// merge changed the file.
+type ConflictType uint8
+
+// Conflict types.
+const (
+	NoConflict ConflictType = iota
+	BothDeleted
+	AddedByUs
+	DeletedByThem
+	AddedByThem
+	DeletedByUs
+	BothAdded
+	BothModified
+)
+
+var conflictNames = []string{
+	NoConflict:    "",
+	BothDeleted:   "both deleted",
+	AddedByUs:     "added by us",
+	DeletedByThem: "deleted by them",
+	AddedByThem:   "added by them",
+	DeletedByUs:   "deleted by us",
+	BothAdded:     "both added",
+	BothModified:  "both modified",
+}
+
+func (c ConflictType) String() string {
+	if int(c) < len(conflictNames) {
+		return conflictNames[c]
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the conflict type as its name, such as "both
+// modified". NoConflict is the empty string.
+func (c ConflictType) MarshalText() ([]byte, error) {
+	if int(c) >= len(conflictNames) {
+		return nil, fmt.Errorf("unknown conflict type %d", uint8(c))
+	}
+	return []byte(conflictNames[c]), nil
+}
+
+// UnmarshalText decodes the conflict type from its name.
+func (c *ConflictType) UnmarshalText(text []byte) error {
+	for i, name := range conflictNames {
+		if name == string(text) {
+			*c = ConflictType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict type %q", text)
+}
+
+// conflictCodes maps the XY codes of unmerged files in git status to the
+// kind of conflict.
+var conflictCodes = map[string]ConflictType{
+	"DD": BothDeleted,
+	"AU": AddedByUs,
+	"UD": DeletedByThem,
+	"UA": AddedByThem,
+	"DU": DeletedByUs,
+	"AA": BothAdded,
+	"UU": BothModified,
+}
@@ -6,91 +6,240 @@ import (
 	"strings"
 )
 
+// colorMode is the kind of color set in the terminal.
+type colorMode uint8
+
+const (
+	colorDefault colorMode = iota
+	colorBasic             // one of the 16 basic colors, code is the SGR code
+	color256               // 256-color palette, code is the index
+	colorRGB               // 24-bit color
+)
+
+// color is a foreground or background color. The zero value is the
+// terminal's default.
+type color struct {
+	mode    colorMode
+	code    uint8
+	r, g, b uint8
+}
+
+// basicColor returns the basic color with the SGR code, such as 31 for red.
+func basicColor(code uint8) color {
+	return color{mode: colorBasic, code: code}
+}
+
+// parseColor parses the name in a #{name} color token: a 256-color palette
+// index of up to three decimal digits, or rrggbb in hex. Returns false if the
+// name is not a color.
+func parseColor(name string) (color, bool) {
+	if len(name) > 0 && len(name) <= 3 && isDigits(name) {
+		n, err := strconv.Atoi(name)
+		if err != nil || n > 255 {
+			return color{}, false
+		}
+		return color{mode: color256, code: uint8(n)}, true
+	}
+	if len(name) == 6 {
+		v, err := strconv.ParseUint(name, 16, 32)
+		if err != nil {
+			return color{}, false
+		}
+		return color{mode: colorRGB, r: uint8(v >> 16), g: uint8(v >> 8), b: uint8(v)}, true
+	}
+	return color{}, false
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// sgr returns the SGR parameters that set the color as the foreground, or as
+// the background if bg is set.
+func (c color) sgr(bg bool) string {
+	// Background codes are the foreground codes + 10.
+	offset := 0
+	if bg {
+		offset = 10
+	}
+	switch c.mode {
+	case colorBasic:
+		return strconv.Itoa(int(c.code) + offset)
+	case color256:
+		return strconv.Itoa(38+offset) + ";5;" + strconv.Itoa(int(c.code))
+	case colorRGB:
+		return strconv.Itoa(38+offset) + ";2;" + strconv.Itoa(int(c.r)) + ";" + strconv.Itoa(int(c.g)) + ";" + strconv.Itoa(int(c.b))
+	}
+	return strconv.Itoa(39 + offset)
+}
+
+// attribute is a text attribute, such as bold. Attributes are stored as bits
+// in formatter.attr.
+type attribute uint8
+
+const (
+	attrBold attribute = iota
+	attrFaint
+	attrItalic
+	attrBlink
+	attrReverse
+	attrStrike
+	attrOverline
+	numAttrs
+)
+
+// attrCodes are the SGR codes that set and clear each attribute. Bold and
+// faint are both cleared by 22.
+var attrCodes = [numAttrs]struct{ on, off string }{
+	attrBold:     {"1", "22"},
+	attrFaint:    {"2", "22"},
+	attrItalic:   {"3", "23"},
+	attrBlink:    {"5", "25"},
+	attrReverse:  {"7", "27"},
+	attrStrike:   {"9", "29"},
+	attrOverline: {"53", "55"},
+}
+
+// underline is the underline style. Styles other than single are extensions
+// that only some terminals support.
+type underline uint8
+
+const (
+	noUnderline underline = iota
+	underlineSingle
+	underlineDouble
+	underlineCurly
+	underlineDotted
+	underlineDashed
+)
+
+// sgr returns the SGR parameters that set the underline style.
+func (u underline) sgr() string {
+	switch u {
+	case noUnderline:
+		return "24"
+	case underlineSingle:
+		return "4"
+	}
+	return "4:" + strconv.Itoa(int(u))
+}
+
 type formatter struct {
-	color        uint8
-	currentColor uint8
-	attr         uint8
-	currentAttr  uint8
+	color            color
+	currentColor     color
+	bg               color
+	currentBg        color
+	attr             uint8
+	currentAttr      uint8
+	underline        underline
+	currentUnderline underline
+
+	// dirty is set if the state of the terminal is not known, so the next
+	// escape code resets it and sets the whole format.
+	dirty bool
+
+	// shell is the shell escape codes are wrapped for.
+	shell Shell
 }
 
-func (f *formatter) setColor(c uint8) {
+func (f *formatter) setColor(c color) {
 	f.color = c
 }
 
 func (f *formatter) clearColor() {
-	f.color = 0
+	f.color = color{}
 }
 
-func (f *formatter) setAttribute(a uint8) {
-	f.attr |= (1 << a)
+func (f *formatter) setBackground(c color) {
+	f.bg = c
 }
 
-func (f *formatter) clearAttribute(a uint8) {
-	f.attr &= ^(1 << a)
+func (f *formatter) clearBackground() {
+	f.bg = color{}
 }
 
-func (f *formatter) attributeSet(a uint8) bool {
-	return (f.attr & (1 << a)) != 0
+func (f *formatter) setAttribute(a attribute) {
+	f.attr |= 1 << a
+}
+
+func (f *formatter) clearAttribute(a attribute) {
+	f.attr &^= 1 << a
+}
+
+func (f *formatter) setUnderline(u underline) {
+	f.underline = u
 }
 
 func (f *formatter) clearAttributes() {
 	f.attr = 0
+	f.underline = noUnderline
 }
 
+// printANSI writes the escape code to change from the current formatting to
+// the new one, only including what changed.
 func (f *formatter) printANSI(b *bytes.Buffer) {
-	if f.color == f.currentColor && f.attr == f.currentAttr {
+	reset := f.dirty
+	if reset {
+		f.dirty = false
+		f.currentColor = color{}
+		f.currentBg = color{}
+		f.currentAttr = 0
+		f.currentUnderline = noUnderline
+	} else if f.color == f.currentColor && f.bg == f.currentBg && f.attr == f.currentAttr && f.underline == f.currentUnderline {
 		return
 	}
+	start, end := f.shell.wrap()
+	b.WriteString(start)
 	b.WriteString("\x1b[")
-	if f.color == 0 && f.attr == 0 {
+	defer b.WriteString(end)
+	if f.color == (color{}) && f.bg == (color{}) && f.attr == 0 && f.underline == noUnderline {
 		// reset all
 		b.WriteString("0m")
-		f.currentColor = 0
+		f.currentColor = color{}
+		f.currentBg = color{}
 		f.currentAttr = 0
+		f.currentUnderline = noUnderline
 		return
 	}
 	mm := []string{}
-	aAdded, aRemoved := attrDiff(f.currentAttr, f.attr)
-	if len(aRemoved) > 0 {
+	if reset {
 		mm = append(mm, "0")
-		var i uint8 = 1
-		for ; i < 8; i++ {
-			if f.attributeSet(i) {
-				mm = append(mm, strconv.Itoa(int(i)))
-			}
+	}
+	added, removed := f.attr&^f.currentAttr, f.currentAttr&^f.attr
+	if removed&(1<<attrBold|1<<attrFaint) != 0 {
+		// 22 clears both bold and faint, set the one that remains again.
+		added |= f.attr & (1<<attrBold | 1<<attrFaint)
+	}
+	var a attribute
+	for ; a < numAttrs; a++ {
+		if removed&(1<<a) == 0 || a == attrFaint && removed&(1<<attrBold) != 0 {
+			continue
 		}
-	} else if len(aAdded) > 0 {
-		for _, a := range aAdded {
-			mm = append(mm, strconv.Itoa(int(a)))
+		mm = append(mm, attrCodes[a].off)
+	}
+	for a = 0; a < numAttrs; a++ {
+		if added&(1<<a) != 0 {
+			mm = append(mm, attrCodes[a].on)
 		}
 	}
-	if f.color != f.currentColor || len(aRemoved) > 0 {
-		mm = append(mm, strconv.Itoa(int(f.color)))
+	if f.underline != f.currentUnderline {
+		mm = append(mm, f.underline.sgr())
+	}
+	if f.color != f.currentColor {
+		mm = append(mm, f.color.sgr(false))
+	}
+	if f.bg != f.currentBg {
+		mm = append(mm, f.bg.sgr(true))
 	}
 	b.WriteString(strings.Join(mm, ";"))
 	b.WriteString("m")
 	f.currentColor = f.color
+	f.currentBg = f.bg
 	f.currentAttr = f.attr
-
-}
-
-func attrDiff(a, b uint8) ([]uint8, []uint8) {
-	added := []uint8{}
-	removed := []uint8{}
-	var i uint8
-	for ; i < 8; i++ {
-		inA := (a & (1 << i)) != 0
-		inB := (b & (1 << i)) != 0
-		if inA && inB {
-			continue
-		}
-		if inB {
-			added = append(added, i)
-			continue
-		}
-		if inA {
-			removed = append(removed, i)
-		}
-	}
-	return added, removed
+	f.currentUnderline = f.underline
 }
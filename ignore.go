@@ -0,0 +1,188 @@
+package gitprompt
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignorePattern is a single line from a .gitignore file.
+type ignorePattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns are matched against the full path relative to the
+	// .gitignore file, others only against the base name.
+	anchored bool
+}
+
+// ignoreList is the patterns from one source, such as a .gitignore file.
+type ignoreList struct {
+	// base is the directory the patterns are relative to, "" for the root
+	// of the working tree.
+	base     string
+	patterns []ignorePattern
+}
+
+// ignoreMatcher decides if paths are ignored. Lists added later take
+// precedence over earlier ones.
+type ignoreMatcher struct {
+	lists []*ignoreList
+}
+
+func parseIgnore(r io.Reader, base string) (*ignoreList, error) {
+	l := &ignoreList{base: base}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p, ok := parseIgnorePattern(scanner.Text()); ok {
+			l.patterns = append(l.patterns, p)
+		}
+	}
+	return l, scanner.Err()
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	p := ignorePattern{}
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" || line[0] == '#' {
+		return p, false
+	}
+	// Trailing spaces are ignored unless escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" {
+		return p, false
+	}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' && len(line) > 1 && (line[1] == '!' || line[1] == '#') {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	p.segments = strings.Split(negatedClasses(line), "/")
+	return p, true
+}
+
+// negatedClasses rewrites the negated character classes [!...] that git
+// accepts as [^...], the only form path.Match understands.
+func negatedClasses(pattern string) string {
+	b := []byte(pattern)
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '[':
+			i++
+			if i < len(b) && b[i] == '!' {
+				b[i] = '^'
+			}
+			// Skip to the end of the class.
+			for i < len(b) && b[i] != ']' {
+				if b[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		}
+	}
+	return string(b)
+}
+
+// openIgnoreFile reads the patterns in the file. Returns nil if the file does
+// not exist.
+func openIgnoreFile(file, base string) (*ignoreList, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIgnore(f, base)
+}
+
+// with returns a matcher with the list added, or the matcher itself if l is
+// nil.
+func (m *ignoreMatcher) with(l *ignoreList) *ignoreMatcher {
+	if l == nil || len(l.patterns) == 0 {
+		return m
+	}
+	lists := make([]*ignoreList, len(m.lists), len(m.lists)+1)
+	copy(lists, m.lists)
+	return &ignoreMatcher{lists: append(lists, l)}
+}
+
+// ignored returns true if the path, relative to the root of the working
+// tree, is ignored.
+func (m *ignoreMatcher) ignored(p string, isDir bool) bool {
+	for i := len(m.lists) - 1; i >= 0; i-- {
+		l := m.lists[i]
+		rel := p
+		if l.base != "" {
+			if !strings.HasPrefix(p, l.base+"/") {
+				continue
+			}
+			rel = p[len(l.base)+1:]
+		}
+		for j := len(l.patterns) - 1; j >= 0; j-- {
+			if l.patterns[j].match(rel, isDir) {
+				return !l.patterns[j].negate
+			}
+		}
+	}
+	return false
+}
+
+func (p ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		return matchSegment(p.segments[0], path.Base(rel))
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				// Trailing /** matches everything inside.
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 || !matchSegment(pattern[0], name[0]) {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+func matchSegment(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	return ok && err == nil
+}
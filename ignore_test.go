@@ -0,0 +1,73 @@
+package gitprompt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	tests := []struct {
+		patterns string
+		base     string
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{patterns: "foo", path: "foo", expected: true},
+		{patterns: "foo", path: "a/b/foo", expected: true},
+		{patterns: "foo", path: "foobar", expected: false},
+		{patterns: "*.log", path: "a/b.log", expected: true},
+		{patterns: "/foo", path: "foo", expected: true},
+		{patterns: "/foo", path: "a/foo", expected: false},
+		{patterns: "a/foo", path: "a/foo", expected: true},
+		{patterns: "a/foo", path: "b/a/foo", expected: false},
+		{patterns: "foo/", path: "foo", expected: false},
+		{patterns: "foo/", path: "foo", isDir: true, expected: true},
+		{patterns: "**/foo", path: "a/b/foo", expected: true},
+		{patterns: "**/foo", path: "foo", expected: true},
+		{patterns: "a/**", path: "a/b/c", expected: true},
+		{patterns: "a/**", path: "a", expected: false},
+		{patterns: "a/**/b", path: "a/b", expected: true},
+		{patterns: "a/**/b", path: "a/x/y/b", expected: true},
+		{patterns: "*.log\n!keep.log", path: "keep.log", expected: false},
+		{patterns: "!keep.log\n*.log", path: "keep.log", expected: true},
+		{patterns: "\\!foo", path: "!foo", expected: true},
+		{patterns: "# comment\n\nfoo   ", path: "foo", expected: true},
+		{patterns: "   \nfoo", path: "foo", expected: true},
+		{patterns: "   ", path: "   ", expected: false},
+		{patterns: "[!a].log", path: "b.log", expected: true},
+		{patterns: "[!a].log", path: "a.log", expected: false},
+		{patterns: "[^a].log", path: "a.log", expected: false},
+		{patterns: "[a!]x", path: "!x", expected: true},
+		{patterns: "\\[!a]", path: "[!a]", expected: true},
+		{patterns: "foo", base: "sub", path: "sub/x/foo", expected: true},
+		{patterns: "/foo", base: "sub", path: "foo", expected: false},
+		{patterns: "/foo", base: "sub", path: "sub/foo", expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.patterns+" "+test.path, func(t *testing.T) {
+			l, err := parseIgnore(strings.NewReader(test.patterns), test.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := (&ignoreMatcher{}).with(l)
+			if actual := m.ignored(test.path, test.isDir); actual != test.expected {
+				t.Errorf("Expected ignored=%v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestIgnorePrecedence(t *testing.T) {
+	root, _ := parseIgnore(strings.NewReader("*.log"), "")
+	sub, _ := parseIgnore(strings.NewReader("!keep.log"), "sub")
+	m := (&ignoreMatcher{}).with(root).with(sub)
+
+	if !m.ignored("keep.log", false) {
+		t.Errorf("Expected keep.log to be ignored in root")
+	}
+	if m.ignored("sub/keep.log", false) {
+		t.Errorf("Expected sub/keep.log to be re-included by sub/.gitignore")
+	}
+}
@@ -0,0 +1,222 @@
+package gitprompt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const (
+	modeTypeMask uint32 = 0170000
+	modeFile     uint32 = 0100000
+	modeSymlink  uint32 = 0120000
+	modeGitlink  uint32 = 0160000
+	modeTree     uint32 = 0040000
+)
+
+// indexEntry is a single file in the index.
+type indexEntry struct {
+	path      string
+	mode      uint32
+	sha       [20]byte
+	size      uint32
+	mtime     uint32
+	mtimeNano uint32
+	stage     int
+
+	assumeValid  bool
+	skipWorktree bool
+	intentToAdd  bool
+}
+
+// index is the parsed contents of .git/index.
+type index struct {
+	entries []indexEntry
+	// trees holds the valid entries of the cached tree extension, keyed by
+	// directory ("" for the root).
+	trees map[string][20]byte
+}
+
+var errIndexCorrupt = errors.New("index file corrupt")
+
+// readIndex reads the index file. Returns an empty index if the file does
+// not exist, which is the case in a new repository.
+func readIndex(path string) (*index, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &index{}, nil
+		}
+		return nil, err
+	}
+	if len(b) < 12+20 || string(b[:4]) != "DIRC" {
+		return nil, errIndexCorrupt
+	}
+	version := binary.BigEndian.Uint32(b[4:8])
+	if version < 2 || version > 4 {
+		return nil, errUnsupported
+	}
+	count := int(binary.BigEndian.Uint32(b[8:12]))
+
+	// The trailing 20 bytes are the checksum of the file.
+	data := b[:len(b)-20]
+	idx := &index{
+		entries: make([]indexEntry, 0, count),
+	}
+	off := 12
+	prev := ""
+	for i := 0; i < count; i++ {
+		start := off
+		if off+62 > len(data) {
+			return nil, errIndexCorrupt
+		}
+		e := indexEntry{
+			mtime:     binary.BigEndian.Uint32(data[off+8:]),
+			mtimeNano: binary.BigEndian.Uint32(data[off+12:]),
+			mode:      binary.BigEndian.Uint32(data[off+24:]),
+			size:      binary.BigEndian.Uint32(data[off+36:]),
+		}
+		copy(e.sha[:], data[off+40:off+60])
+		flags := binary.BigEndian.Uint16(data[off+60:])
+		off += 62
+		e.assumeValid = flags&0x8000 != 0
+		e.stage = int(flags>>12) & 3
+		if version >= 3 && flags&0x4000 != 0 {
+			if off+2 > len(data) {
+				return nil, errIndexCorrupt
+			}
+			ext := binary.BigEndian.Uint16(data[off:])
+			e.skipWorktree = ext&0x4000 != 0
+			e.intentToAdd = ext&0x2000 != 0
+			off += 2
+		}
+
+		if version == 4 {
+			// Paths are prefix compressed against the previous entry.
+			strip, n := readOffset(data[off:])
+			if n == 0 || strip > len(prev) {
+				return nil, errIndexCorrupt
+			}
+			off += n
+			end := bytes.IndexByte(data[off:], 0)
+			if end < 0 {
+				return nil, errIndexCorrupt
+			}
+			e.path = prev[:len(prev)-strip] + string(data[off:off+end])
+			off += end + 1
+		} else {
+			end := bytes.IndexByte(data[off:], 0)
+			if end < 0 {
+				return nil, errIndexCorrupt
+			}
+			e.path = string(data[off : off+end])
+			off += end + 1
+			// Entries are padded with NULs to a multiple of 8 bytes.
+			for (off-start)%8 != 0 {
+				off++
+			}
+		}
+		prev = e.path
+		idx.entries = append(idx.entries, e)
+	}
+
+	for off+8 <= len(data) {
+		sig := string(data[off : off+4])
+		size := int(binary.BigEndian.Uint32(data[off+4:]))
+		off += 8
+		if off+size > len(data) {
+			return nil, errIndexCorrupt
+		}
+		ext := data[off : off+size]
+		off += size
+		switch {
+		case sig == "TREE":
+			idx.trees = make(map[string][20]byte)
+			if _, ok := readCacheTree(ext, "", idx.trees); !ok {
+				idx.trees = nil
+			}
+		case sig[0] >= 'A' && sig[0] <= 'Z':
+			// Optional extension.
+		default:
+			// Extensions starting with a lower case letter must be
+			// understood, such as split or sparse indexes.
+			return nil, errUnsupported
+		}
+	}
+
+	return idx, nil
+}
+
+// readCacheTree reads the cached tree extension, adding the sha of each
+// valid tree to trees. Returns the number of bytes consumed.
+func readCacheTree(b []byte, dir string, trees map[string][20]byte) (int, bool) {
+	end := bytes.IndexByte(b, 0)
+	if end < 0 {
+		return 0, false
+	}
+	name := string(b[:end])
+	off := end + 1
+	nl := bytes.IndexByte(b[off:], '\n')
+	if nl < 0 {
+		return 0, false
+	}
+	fields := bytes.Fields(b[off : off+nl])
+	if len(fields) != 2 {
+		return 0, false
+	}
+	entries, err := strconv.Atoi(string(fields[0]))
+	if err != nil {
+		return 0, false
+	}
+	subtrees, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0, false
+	}
+	off += nl + 1
+
+	path := name
+	if dir != "" {
+		path = dir + "/" + name
+	}
+	if entries >= 0 {
+		if off+20 > len(b) {
+			return 0, false
+		}
+		var sha [20]byte
+		copy(sha[:], b[off:off+20])
+		trees[path] = sha
+		off += 20
+	}
+	for i := 0; i < subtrees; i++ {
+		n, ok := readCacheTree(b[off:], path, trees)
+		if !ok {
+			return 0, false
+		}
+		off += n
+	}
+	return off, true
+}
+
+// readOffset reads a variable length integer in the format used for offsets
+// in pack files and path prefixes in version 4 indexes. Returns the value and
+// the number of bytes read, or 0 bytes if b is too short.
+func readOffset(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	c := b[0]
+	v := int(c & 0x7f)
+	n := 1
+	for c&0x80 != 0 {
+		if n >= len(b) {
+			return 0, 0
+		}
+		c = b[n]
+		n++
+		v = ((v + 1) << 7) | int(c&0x7f)
+	}
+	return v, n
+}
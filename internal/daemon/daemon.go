@@ -0,0 +1,516 @@
+// Package daemon serves the status of repositories over a Unix socket. The
+// server keeps the status of each repository it's asked about and refreshes it
+// in the background when files change, so the prompt doesn't wait for git.
+//
+// Changes are only noticed with inotify on Linux. Elsewhere the server gets
+// the status again for every request.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/akupila/gitprompt"
+)
+
+// debounce is how long the server waits after a change before it gets the
+// status again, so a burst of changes causes one refresh.
+const debounce = 50 * time.Millisecond
+
+// minRefresh is the least time between refreshes of a repository, so that a
+// build writing to the working tree all the time doesn't keep git busy. The
+// status is still read again if it's requested after a change.
+const minRefresh = time.Second
+
+// idleTimeout is how long a repository is kept by default after it was last
+// asked about.
+const idleTimeout = time.Hour
+
+// maxWatches limits how many directories are watched in a repository. The
+// status of larger repositories is not cached.
+const maxWatches = 8192
+
+// Request asks for the status of the repository Dir is in.
+type Request struct {
+	// Dir is an absolute path in the repository.
+	Dir string `json:"dir"`
+	// Native gets the status with gitprompt.NativeSource instead of
+	// gitprompt.ExecSource.
+	Native bool `json:"native,omitempty"`
+	// Untracked is how untracked files are found.
+	Untracked gitprompt.UntrackedMode `json:"untracked,omitempty"`
+}
+
+// Response is the answer to a request. Status is nil if the directory is not
+// in a repository.
+type Response struct {
+	Status *gitprompt.GitStatus `json:"status"`
+	Error  string               `json:"error,omitempty"`
+}
+
+// Source gets the status from the daemon listening on Socket. It implements
+// gitprompt.StatusSource.
+type Source struct {
+	// Socket is the path of the daemon's socket.
+	Socket string
+	// Request is what's asked from the daemon. The directory defaults to the
+	// current directory.
+	Request Request
+	// Fallback gets the status if the daemon can't be reached. If nil, the
+	// error is returned instead.
+	Fallback gitprompt.StatusSource
+}
+
+// Status implements gitprompt.StatusSource.
+func (src Source) Status(ctx context.Context) (*gitprompt.GitStatus, error) {
+	s, err := src.status(ctx)
+	if err != nil && err != context.DeadlineExceeded && err != context.Canceled && src.Fallback != nil {
+		return src.Fallback.Status(ctx)
+	}
+	return s, err
+}
+
+func (src Source) status(ctx context.Context) (*gitprompt.GitStatus, error) {
+	req := src.Request
+	dir, err := filepath.Abs(req.Dir)
+	if err != nil {
+		return nil, err
+	}
+	req.Dir = dir
+
+	if err := checkSocket(src.Socket); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", src.Socket)
+	if err != nil {
+		return nil, wrapContext(ctx, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, wrapContext(ctx, err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, wrapContext(ctx, err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Status, nil
+}
+
+// wrapContext returns context.DeadlineExceeded if the error is because the
+// context's deadline was reached. The connection's deadline may pass before
+// the context notices.
+func wrapContext(ctx context.Context, err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if _, ok := ctx.Deadline(); ok {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// Server answers requests for the status of repositories.
+type Server struct {
+	// NewSource returns the source to get the status for the request with.
+	// Defaults to gitprompt.ExecSource or gitprompt.NativeSource.
+	NewSource func(req Request) gitprompt.StatusSource
+	// IdleTimeout is how long a repository's status is kept, and its files
+	// watched, after it was last asked about. Defaults to an hour.
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	repos   map[string]*repo
+	dirs    map[string]*repo
+	watcher watcher
+	// sweeper drops the repositories that have been idle too long.
+	sweeper *time.Timer
+	closed  bool
+
+	listeners map[net.Listener]bool
+}
+
+// repo is a repository the server has been asked about.
+type repo struct {
+	workTree  string
+	gitDir    string
+	commonDir string
+
+	mu sync.Mutex
+	// watched is set if the repository is watched for changes.
+	watched bool
+	entries map[Request]*entry
+	// used is when the status was last asked for.
+	used time.Time
+	// timer is set while a refresh is scheduled, refreshed is when the last
+	// one started.
+	timer     *time.Timer
+	refreshed time.Time
+}
+
+// entry is the status of a repository for one kind of request.
+type entry struct {
+	src gitprompt.StatusSource
+	// cache is set if the status is kept until something changes.
+	cache bool
+
+	// stale is 1 if the status needs to be read again.
+	stale int32
+
+	mu     sync.Mutex
+	status *gitprompt.GitStatus
+	err    error
+}
+
+// Serve answers requests on the listener until the server is closed, then
+// returns nil. The listener is closed with the server.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops the server, closing its listeners.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.watcher != nil {
+		if e := s.watcher.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.sweeper != nil {
+		s.sweeper.Stop()
+	}
+	for _, r := range s.repos {
+		r.mu.Lock()
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	var req Request
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("daemon: invalid request: %v", err)
+	} else {
+		status, err := s.Status(req)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Status = status
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// Status returns the status for the request, from the cache if nothing has
+// changed since it was last read.
+func (s *Server) Status(req Request) (*gitprompt.GitStatus, error) {
+	if !filepath.IsAbs(req.Dir) {
+		return nil, fmt.Errorf("daemon: dir %q is not absolute", req.Dir)
+	}
+	r, err := s.repo(req.Dir)
+	if r == nil || err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	w := s.watcher
+	s.mu.Unlock()
+	if w != nil {
+		// The changes made just before the request may not have been
+		// noticed yet.
+		w.sync()
+	}
+	// The status is the same anywhere in the repository.
+	req.Dir = r.workTree
+	return s.entry(r, req).get()
+}
+
+// repo returns the repository dir is in, or nil if it's not in one.
+func (s *Server) repo(dir string) (*repo, error) {
+	s.mu.Lock()
+	r := s.dirs[dir]
+	s.mu.Unlock()
+	if r != nil {
+		return r, nil
+	}
+
+	r, err := findRepo(dir)
+	if r == nil || err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repos == nil {
+		s.repos = make(map[string]*repo)
+		s.dirs = make(map[string]*repo)
+		w, err := newWatcher()
+		if err == nil {
+			s.watcher = w
+		}
+		s.sweeper = time.AfterFunc(s.sweepInterval(), s.sweep)
+	}
+	if existing := s.repos[r.workTree]; existing != nil {
+		r = existing
+	} else {
+		r.used = time.Now()
+		s.repos[r.workTree] = r
+		watched := s.watch(r) == nil
+		if !watched && s.watcher != nil {
+			// Drop the directories watched before the error.
+			s.watcher.remove(r.workTree)
+		}
+		r.mu.Lock()
+		r.watched = watched
+		r.mu.Unlock()
+	}
+	s.dirs[dir] = r
+	return r, nil
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return idleTimeout
+}
+
+// sweepInterval is how often idle repositories are looked for. They are
+// dropped at most this long after their timeout.
+func (s *Server) sweepInterval() time.Duration {
+	return s.idleTimeout() / 4
+}
+
+// sweep drops the repositories that have not been asked about within the
+// idle timeout, and schedules the next sweep.
+func (s *Server) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, r := range s.repos {
+		r.mu.Lock()
+		idle := time.Since(r.used) >= s.idleTimeout()
+		r.mu.Unlock()
+		if idle {
+			s.drop(r)
+		}
+	}
+	s.sweeper.Reset(s.sweepInterval())
+}
+
+// drop forgets the repository and stops watching it. A request already
+// holding it reads the status again. s.mu must be held.
+func (s *Server) drop(r *repo) {
+	delete(s.repos, r.workTree)
+	for dir, dr := range s.dirs {
+		if dr == r {
+			delete(s.dirs, dir)
+		}
+	}
+	if s.watcher != nil {
+		s.watcher.remove(r.workTree)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watched = false
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	for _, e := range r.entries {
+		atomic.StoreInt32(&e.stale, 1)
+	}
+}
+
+// watch watches the working tree and the files in the git dir that change
+// the status.
+func (s *Server) watch(r *repo) error {
+	if s.watcher == nil {
+		return errNoWatcher
+	}
+	dirs := []watchDir{
+		{r.workTree, true},
+		{r.gitDir, false},
+		{filepath.Join(r.commonDir, "refs"), true},
+		{filepath.Join(r.commonDir, "logs", "refs"), false},
+	}
+	if r.commonDir != r.gitDir {
+		// Linked working tree, packed-refs is in the common dir.
+		dirs = append(dirs, watchDir{r.commonDir, false})
+	}
+	for _, w := range dirs {
+		err := s.watcher.add(r.workTree, w.dir, w.recursive, r.changed)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type watchDir struct {
+	dir       string
+	recursive bool
+}
+
+func (s *Server) entry(r *repo, req Request) *entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.used = time.Now()
+	if e := r.entries[req]; e != nil {
+		return e
+	}
+	if r.entries == nil {
+		r.entries = make(map[Request]*entry)
+	}
+	newSource := s.NewSource
+	if newSource == nil {
+		newSource = defaultSource
+	}
+	e := &entry{src: newSource(req), cache: r.watched, stale: 1}
+	r.entries[req] = e
+	return e
+}
+
+func defaultSource(req Request) gitprompt.StatusSource {
+	if req.Native {
+		return gitprompt.NativeSource{Dir: req.Dir, Untracked: req.Untracked}
+	}
+	return gitprompt.ExecSource{Dir: req.Dir, Untracked: req.Untracked}
+}
+
+// changed marks the statuses of the repository stale and schedules a
+// refresh, unless one is already scheduled.
+func (r *repo) changed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		atomic.StoreInt32(&e.stale, 1)
+	}
+	if r.timer != nil {
+		return
+	}
+	delay := debounce
+	if wait := time.Until(r.refreshed.Add(minRefresh)); wait > delay {
+		delay = wait
+	}
+	r.timer = time.AfterFunc(delay, r.refresh)
+}
+
+// refresh reads the stale statuses again.
+func (r *repo) refresh() {
+	r.mu.Lock()
+	r.timer = nil
+	r.refreshed = time.Now()
+	if !r.watched {
+		r.mu.Unlock()
+		return
+	}
+	entries := make([]*entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+	for _, e := range entries {
+		_, _ = e.get()
+	}
+}
+
+// get returns the status, reading it again if it's stale. Statuses of
+// repositories that are not watched are always stale.
+func (e *entry) get() (*gitprompt.GitStatus, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if atomic.SwapInt32(&e.stale, 0) == 1 || !e.cache {
+		e.status, e.err = e.src.Status(context.Background())
+		if e.err != nil {
+			// Try again next time.
+			atomic.StoreInt32(&e.stale, 1)
+		}
+	}
+	return e.status, e.err
+}
+
+// findRepo finds the repository dir is in by asking git. Returns nil if dir
+// is not in a repository.
+func findRepo(dir string) (*repo, error) {
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel", "--absolute-git-dir", "--git-common-dir")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// Not a repository, or a bare one.
+			return nil, nil
+		}
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 {
+		return nil, nil
+	}
+	commonDir := lines[2]
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(dir, commonDir)
+	}
+	return &repo{
+		workTree:  lines[0],
+		gitDir:    lines[1],
+		commonDir: filepath.Clean(commonDir),
+	}, nil
+}
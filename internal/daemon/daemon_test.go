@@ -0,0 +1,284 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akupila/gitprompt"
+)
+
+func TestSource(t *testing.T) {
+	dir, done := setupRepo(t, `
+		touch a
+		mkdir sub
+		touch sub/b
+	`)
+	defer done()
+	socket, stop := startServer(t, &Server{})
+	defer stop()
+
+	expected, err := gitprompt.ParseDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{dir, filepath.Join(dir, "sub")} {
+		s, err := Source{Socket: socket, Request: Request{Dir: d}}.Status(context.Background())
+		if err != nil {
+			t.Fatalf("%s: Received unexpected error: %v", d, err)
+		}
+		if s == nil {
+			t.Fatalf("%s: Expected status, got nil", d)
+		}
+		assertString(t, "Branch", expected.Branch, s.Branch)
+		assertInt(t, "Untracked", expected.Untracked, s.Untracked)
+	}
+
+	s, err := Source{Socket: socket, Request: Request{Dir: dir, Native: true, Untracked: gitprompt.UntrackedAll}}.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	assertInt(t, "Untracked", 2, s.Untracked)
+}
+
+func TestSourceNotRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitprompt-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, stop := startServer(t, &Server{})
+	defer stop()
+
+	s, err := Source{Socket: socket, Request: Request{Dir: dir}}.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if s != nil {
+		t.Errorf("Expected nil status outside a repository, got %+v", s)
+	}
+}
+
+func TestSourceFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitprompt-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "missing.sock")
+
+	fallback := gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+		return &gitprompt.GitStatus{Branch: "fallback"}, nil
+	})
+	s, err := Source{Socket: socket, Fallback: fallback}.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	assertString(t, "Branch", "fallback", s.Branch)
+
+	if _, err := (Source{Socket: socket}).Status(context.Background()); err == nil {
+		t.Errorf("Expected error without fallback")
+	}
+}
+
+func TestSourceTimeout(t *testing.T) {
+	dir, done := setupRepo(t, "")
+	defer done()
+	release := make(chan struct{})
+	defer close(release)
+	srv := &Server{
+		NewSource: func(req Request) gitprompt.StatusSource {
+			return gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+				<-release
+				return &gitprompt.GitStatus{}, nil
+			})
+		},
+	}
+	socket, stop := startServer(t, srv)
+	defer stop()
+
+	fallback := gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+		t.Errorf("Fallback should not be used when the context is done")
+		return nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := Source{Socket: socket, Request: Request{Dir: dir}, Fallback: fallback}.Status(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestServerInvalidRequest(t *testing.T) {
+	socket, stop := startServer(t, &Server{})
+	defer stop()
+
+	for _, req := range []string{"nope\n", `{"dir":"relative"}` + "\n"} {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if resp.Error == "" {
+			t.Errorf("%q: Expected error", req)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitprompt-daemon-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "sub", "gitprompt.sock")
+
+	l, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{socket, filepath.Dir(socket)} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			t.Errorf("%s: expected only the user to have access, got %v", p, fi.Mode())
+		}
+	}
+	if _, err := Listen(socket); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("Expected error for a running daemon, got %v", err)
+	}
+
+	// A socket left behind is replaced.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = Listen(socket); err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, got %v", err)
+	}
+	l.Close()
+
+	// Anything else is not removed.
+	if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(socket); err == nil {
+		t.Errorf("Expected error for a file in place of the socket")
+	}
+
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(filepath.Join(shared, "gitprompt.sock")); err == nil {
+		t.Errorf("Expected error for a directory writable by others")
+	}
+}
+
+func TestSourceNotSocket(t *testing.T) {
+	dir, done := setupRepo(t, "")
+	defer done()
+	socket, stop := startServer(t, &Server{})
+	defer stop()
+
+	link := filepath.Join(dir, "link.sock")
+	if err := os.Symlink(socket, link); err != nil {
+		t.Fatal(err)
+	}
+	fallback := gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+		return &gitprompt.GitStatus{Branch: "fallback"}, nil
+	})
+	s, err := Source{Socket: link, Request: Request{Dir: dir}, Fallback: fallback}.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	assertString(t, "Branch", "fallback", s.Branch)
+}
+
+// setupRepo creates a repository with one commit and runs the commands in
+// it.
+func setupRepo(t *testing.T, commands string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gitprompt-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The temp dir may be a symlink, git reports the real path.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	run(t, dir, `
+		git init
+		git commit --allow-empty -m 'initial'
+	`+commands)
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func run(t *testing.T, dir, commands string) {
+	t.Helper()
+	cmd := exec.Command("bash", "-c", "set -eo pipefail\n"+commands)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Setup command failed: %v\n%s", err, out)
+	}
+}
+
+// startServer serves on a socket in a temp dir.
+func startServer(t *testing.T, srv *Server) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gitprompt-daemon-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "gitprompt.sock")
+	l, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+	return socket, func() {
+		if err := srv.Close(); err != nil && !strings.Contains(err.Error(), "use of closed") {
+			t.Errorf("Close: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func assertString(t *testing.T, name, expected, actual string) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("%s does not match\n\tExpected: %q\n\tActual:   %q", name, expected, actual)
+	}
+}
+
+func assertInt(t *testing.T, name string, expected, actual int) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("%s does not match\n\tExpected: %d\n\tActual:   %d", name, expected, actual)
+	}
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// DefaultSocket returns the path of the socket in $XDG_RUNTIME_DIR, or in a
+// directory of the user's own in the temporary directory if it's not set.
+func DefaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gitprompt.sock")
+	}
+	return filepath.Join(os.TempDir(), "gitprompt-"+strconv.Itoa(os.Getuid()), "gitprompt.sock")
+}
+
+// Listen listens on the socket, which is only accessible by the user. The
+// directory it's in is created if it doesn't exist, and must belong to the
+// user and not be writable by others, so that no one else can replace the
+// socket. A socket left behind by a daemon that didn't exit cleanly is
+// removed.
+func Listen(socket string) (net.Listener, error) {
+	dir := filepath.Dir(socket)
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() || !ownedByUser(fi) || fi.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("daemon: %s must be a directory that belongs to you and is not writable by others", dir)
+	}
+
+	if conn, err := net.Dial("unix", socket); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("daemon: already running on %s", socket)
+	}
+	if err := checkSocket(socket); err == nil {
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var l net.Listener
+	err = withUmask(0077, func() error {
+		var err error
+		l, err = net.Listen("unix", socket)
+		return err
+	})
+	return l, err
+}
+
+// checkSocket returns an error if the file is not a socket that belongs to
+// the user, as another user could use it to make up the status printed in the
+// prompt.
+func checkSocket(socket string) error {
+	fi, err := os.Lstat(socket)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 || !ownedByUser(fi) {
+		return fmt.Errorf("daemon: %s is not a socket that belongs to you", socket)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9 && !js
+// +build !windows,!plan9,!js
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedByUser returns true if the file belongs to the current user.
+func ownedByUser(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
+
+// withUmask calls f with the umask set to mask, so that files it creates
+// never have more permissions.
+func withUmask(mask int, f func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
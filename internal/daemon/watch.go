@@ -0,0 +1,22 @@
+package daemon
+
+import "errors"
+
+// watcher calls functions when files in directories change.
+type watcher interface {
+	// add watches dir, and its subdirectories if recursive is set, calling
+	// changed when anything in them changes. id names the owner of the
+	// watch for remove.
+	add(id, dir string, recursive bool, changed func()) error
+	// remove stops the watches added with id.
+	remove(id string)
+	// sync calls the functions for the changes made before it was called,
+	// if they have not been called yet.
+	sync()
+	close() error
+}
+
+var (
+	errNoWatcher      = errors.New("daemon: watching files is not supported")
+	errTooManyWatches = errors.New("daemon: too many directories to watch")
+)
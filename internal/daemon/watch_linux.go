@@ -0,0 +1,226 @@
+//go:build linux
+// +build linux
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask are the events that change the status.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// inotify watches directories with inotify(7).
+type inotify struct {
+	f *os.File
+	// fd is the file's descriptor. f.Fd would make it blocking.
+	fd int
+
+	mu      sync.Mutex
+	watches map[int32]*inotifyWatch
+
+	// readMu is held while events are read and handled, so that sync
+	// returns only once the events queued before it are handled.
+	readMu sync.Mutex
+	closed bool
+	buf    []byte
+}
+
+// inotifyWatch is a watched directory. changed has the function to call for
+// each owner of the watch.
+type inotifyWatch struct {
+	dir       string
+	recursive bool
+	changed   map[string]func()
+}
+
+func newWatcher() (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotify{
+		// The file is non-blocking, so waiting for events happens in the
+		// runtime's poller and closing the file stops it.
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		watches: make(map[int32]*inotifyWatch),
+		buf:     make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotify) add(id, dir string, recursive bool, changed func()) error {
+	dirs := []string{dir}
+	if recursive {
+		var err error
+		if dirs, err = listDirs(dir); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, d := range dirs {
+		wd, err := syscall.InotifyAddWatch(w.fd, d, inotifyMask)
+		if err != nil {
+			if d == dir {
+				return &os.PathError{Op: "inotify_add_watch", Path: d, Err: err}
+			}
+			// Removed since it was listed.
+			continue
+		}
+		iw := w.watches[int32(wd)]
+		if iw == nil {
+			iw = &inotifyWatch{dir: d, recursive: recursive, changed: make(map[string]func())}
+			w.watches[int32(wd)] = iw
+		}
+		iw.changed[id] = changed
+	}
+	return nil
+}
+
+// remove removes id from the watches, and the watches left without owners
+// from inotify.
+func (w *inotify) remove(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for wd, iw := range w.watches {
+		delete(iw.changed, id)
+		if len(iw.changed) == 0 {
+			_, _ = syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+// listDirs returns dir and the directories in it, except .git directories.
+// Returns errTooManyWatches if there are more than maxWatches.
+func listDirs(dir string) ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if fi.Name() == ".git" && path != dir {
+			return filepath.SkipDir
+		}
+		if len(dirs) == maxWatches {
+			return errTooManyWatches
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	return dirs, err
+}
+
+// sync handles the events queued before it was called, which the watcher
+// may not have got to yet.
+func (w *inotify) sync() {
+	_ = w.read()
+}
+
+func (w *inotify) close() error {
+	w.readMu.Lock()
+	w.closed = true
+	w.readMu.Unlock()
+	return w.f.Close()
+}
+
+// run handles events until the watcher is closed.
+func (w *inotify) run() {
+	rc, err := w.f.SyscallConn()
+	if err != nil {
+		return
+	}
+	// Returning false waits in the runtime's poller until there are more
+	// events.
+	_ = rc.Read(func(uintptr) bool {
+		return w.read() != nil
+	})
+}
+
+// read handles the queued events. Returns an error if the watcher is closed.
+func (w *inotify) read() error {
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	for {
+		if w.closed {
+			return os.ErrClosed
+		}
+		n, err := syscall.Read(w.fd, w.buf)
+		switch err {
+		case nil:
+		case syscall.EAGAIN:
+			return nil
+		case syscall.EINTR:
+			continue
+		default:
+			return os.NewSyscallError("read", err)
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&w.buf[off]))
+			name := w.buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(ev, string(trimNul(name)))
+		}
+	}
+}
+
+func (w *inotify) handle(ev *syscall.InotifyEvent, name string) {
+	w.mu.Lock()
+	changed := make(map[string]func())
+	var newDir string
+	switch {
+	case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+		// Events were lost, anything may have changed.
+		for _, iw := range w.watches {
+			for id, fn := range iw.changed {
+				changed[id] = fn
+			}
+		}
+	case ev.Mask&syscall.IN_IGNORED != 0:
+		delete(w.watches, ev.Wd)
+	default:
+		iw := w.watches[ev.Wd]
+		if iw == nil {
+			break
+		}
+		for id, fn := range iw.changed {
+			changed[id] = fn
+		}
+		if iw.recursive && ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && name != ".git" {
+			newDir = filepath.Join(iw.dir, name)
+		}
+	}
+	w.mu.Unlock()
+
+	if newDir != "" {
+		for id, fn := range changed {
+			_ = w.add(id, newDir, true, fn)
+		}
+	}
+	for _, fn := range changed {
+		fn()
+	}
+}
+
+func trimNul(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,195 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akupila/gitprompt"
+)
+
+func TestServerCache(t *testing.T) {
+	dir, done := setupRepo(t, "")
+	defer done()
+	var count int32
+	srv := &Server{
+		NewSource: func(req Request) gitprompt.StatusSource {
+			return gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+				atomic.AddInt32(&count, 1)
+				return gitprompt.ExecSource{Dir: req.Dir, Untracked: req.Untracked}.Status(ctx)
+			})
+		},
+	}
+	socket, stop := startServer(t, srv)
+	defer stop()
+	src := Source{Socket: socket, Request: Request{Dir: dir, Untracked: gitprompt.UntrackedAll}}
+
+	for i := 0; i < 3; i++ {
+		if _, err := src.Status(context.Background()); err != nil {
+			t.Fatalf("Received unexpected error: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("Expected the status to be read once, got %d", n)
+	}
+
+	run(t, dir, "touch a")
+	waitFor(t, src, "untracked file", func(s *gitprompt.GitStatus) bool {
+		return s.Untracked == 1
+	})
+
+	// Files in new directories are noticed too.
+	run(t, dir, "mkdir sub")
+	time.Sleep(2 * debounce)
+	run(t, dir, "touch sub/b")
+	waitFor(t, src, "untracked file in new dir", func(s *gitprompt.GitStatus) bool {
+		return s.Untracked == 2
+	})
+
+	run(t, dir, "git add a")
+	waitFor(t, src, "staged file", func(s *gitprompt.GitStatus) bool {
+		return s.Staged == 1 && s.Untracked == 1
+	})
+
+	run(t, dir, "git commit -m 'add a' && git checkout -b feature")
+	waitFor(t, src, "branch", func(s *gitprompt.GitStatus) bool {
+		return s.Branch == "feature" && s.Staged == 0
+	})
+}
+
+func TestServerRefreshLimit(t *testing.T) {
+	dir, done := setupRepo(t, "echo build > .gitignore")
+	defer done()
+	var count int32
+	srv := &Server{
+		NewSource: func(req Request) gitprompt.StatusSource {
+			return gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+				atomic.AddInt32(&count, 1)
+				return &gitprompt.GitStatus{}, nil
+			})
+		},
+	}
+	socket, stop := startServer(t, srv)
+	defer stop()
+	src := Source{Socket: socket, Request: Request{Dir: dir}}
+	if _, err := src.Status(context.Background()); err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+
+	// A build writing for a while.
+	run(t, dir, "mkdir build")
+	start := time.Now()
+	for time.Since(start) < 2*minRefresh {
+		run(t, dir, "date > build/out")
+		time.Sleep(2 * debounce)
+	}
+	time.Sleep(minRefresh + debounce)
+	if n := atomic.LoadInt32(&count); n > 5 {
+		t.Errorf("Expected at most one refresh per %v, got %d", minRefresh, n-1)
+	}
+}
+
+// waitFor requests the status until ok returns true.
+func waitFor(t *testing.T, src Source, name string, ok func(s *gitprompt.GitStatus) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := src.Status(context.Background())
+		if err != nil {
+			t.Fatalf("%s: Received unexpected error: %v", name, err)
+		}
+		if ok(s) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: Status not updated: %+v", name, s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerIdle(t *testing.T) {
+	dir, done := setupRepo(t, "mkdir sub")
+	defer done()
+	var count int32
+	srv := &Server{
+		NewSource: func(req Request) gitprompt.StatusSource {
+			return gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+				atomic.AddInt32(&count, 1)
+				return &gitprompt.GitStatus{}, nil
+			})
+		},
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	socket, stop := startServer(t, srv)
+	defer stop()
+	src := Source{Socket: socket, Request: Request{Dir: dir}}
+	if _, err := src.Status(context.Background()); err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	srv.mu.Lock()
+	w := srv.watcher.(*inotify)
+	srv.mu.Unlock()
+	watches := func() int {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.watches)
+	}
+	if watches() == 0 {
+		t.Fatalf("Expected the repository to be watched")
+	}
+
+	time.Sleep(3 * srv.IdleTimeout)
+	srv.mu.Lock()
+	repos, dirs := len(srv.repos), len(srv.dirs)
+	srv.mu.Unlock()
+	if n := watches(); repos != 0 || dirs != 0 || n != 0 {
+		t.Errorf("Expected the idle repository to be dropped, got %d repos, %d dirs and %d watches", repos, dirs, n)
+	}
+
+	// Asking again starts over.
+	if _, err := src.Status(context.Background()); err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&count); n != 2 {
+		t.Errorf("Expected the status to be read again, got %d reads", n)
+	}
+}
+
+func TestServerChangeBeforeRequest(t *testing.T) {
+	dir, done := setupRepo(t, "")
+	defer done()
+	var untracked int32
+	srv := &Server{
+		NewSource: func(req Request) gitprompt.StatusSource {
+			return gitprompt.StatusFunc(func(ctx context.Context) (*gitprompt.GitStatus, error) {
+				return &gitprompt.GitStatus{Untracked: int(atomic.LoadInt32(&untracked))}, nil
+			})
+		},
+	}
+	defer srv.Close()
+	req := Request{Dir: dir}
+	if _, err := srv.Status(req); err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+
+	// The status asked for right after a change includes it, even if the
+	// events are not handled yet when the request comes in.
+	for i := 1; i <= 100; i++ {
+		atomic.StoreInt32(&untracked, int32(i))
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := srv.Status(req)
+		if err != nil {
+			t.Fatalf("Received unexpected error: %v", err)
+		}
+		if s.Untracked != i {
+			t.Fatalf("Expected %d untracked files right after the change, got %d", i, s.Untracked)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package daemon
+
+func newWatcher() (watcher, error) {
+	return nil, errNoWatcher
+}
@@ -0,0 +1,294 @@
+// Package gitconfig reads files in the format used by git config.
+package gitconfig
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth limits how deep include.path can be nested, to avoid
+// include loops.
+const maxIncludeDepth = 10
+
+// Config holds the values in a config file.
+type Config struct {
+	values map[string][]string
+	// sections are the names of the sections in the order they first
+	// appear, such as "core" or "branch.master".
+	sections []string
+}
+
+// Parse parses the config in r. Includes are not followed.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{values: make(map[string][]string)}
+	if err := c.parse(r, "", 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReadFile reads the config file, following include.path directives. Returns
+// an empty config if the file does not exist.
+func ReadFile(path string) (*Config, error) {
+	c := &Config{values: make(map[string][]string)}
+	if err := c.readFile(path, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) readFile(path string, depth int) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := c.parse(f, path, depth); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Get returns the last value of the key, such as "core.bare" or
+// "branch.master.remote".
+func (c *Config) Get(key string) (string, bool) {
+	v := c.values[normalize(key)]
+	if len(v) == 0 {
+		return "", false
+	}
+	return v[len(v)-1], true
+}
+
+// Section returns the last value of each key in the section, such as
+// "branch.master", by lower case key name.
+func (c *Config) Section(name string) map[string]string {
+	// Normalize the name the way it is in a key, keeping the dot.
+	prefix := strings.TrimSuffix(normalize(name+".x"), "x")
+	values := make(map[string]string)
+	for key, v := range c.values {
+		if !strings.HasPrefix(key, prefix) || strings.IndexByte(key[len(prefix):], '.') >= 0 {
+			continue
+		}
+		values[key[len(prefix):]] = v[len(v)-1]
+	}
+	return values
+}
+
+// Subsections returns the subsections of the section in the order they first
+// appear, such as the names of the remotes for "remote".
+func (c *Config) Subsections(section string) []string {
+	prefix := strings.ToLower(section) + "."
+	var subs []string
+	for _, s := range c.sections {
+		if strings.HasPrefix(s, prefix) {
+			subs = append(subs, s[len(prefix):])
+		}
+	}
+	return subs
+}
+
+// Bool returns the value of the key as a boolean. Returns false if the key
+// is not set or not a valid boolean.
+func (c *Config) Bool(key string) (bool, bool) {
+	v, ok := c.Get(key)
+	if !ok {
+		return false, false
+	}
+	return ParseBool(v)
+}
+
+// ParseBool parses a boolean the way git does.
+func ParseBool(v string) (bool, bool) {
+	switch strings.ToLower(v) {
+	case "true", "yes", "on", "1":
+		return true, true
+	case "false", "no", "off", "0", "":
+		return false, true
+	}
+	return false, false
+}
+
+// normalize lower cases the section and key name, but not the subsection.
+func normalize(key string) string {
+	first := strings.IndexByte(key, '.')
+	last := strings.LastIndexByte(key, '.')
+	if first < 0 {
+		return strings.ToLower(key)
+	}
+	return strings.ToLower(key[:first]) + key[first:last] + strings.ToLower(key[last:])
+}
+
+var errSyntax = errors.New("syntax error")
+
+func (c *Config) parse(r io.Reader, path string, depth int) error {
+	scanner := bufio.NewScanner(r)
+	section := ""
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		// Values can continue on the next line with a trailing backslash.
+		for strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") && scanner.Scan() {
+			lineNum++
+			line = line[:len(line)-1] + scanner.Text()
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			s, rest, err := parseSection(line)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			section = s
+			c.addSection(s)
+			line = strings.TrimSpace(rest)
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+		if section == "" {
+			return fmt.Errorf("line %d: key outside section", lineNum)
+		}
+
+		// A key without a value is true.
+		name := line
+		if end := strings.IndexAny(line, " \t#;"); end >= 0 {
+			name = line[:end]
+		}
+		value := "true"
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			name = strings.TrimSpace(line[:eq])
+			v, err := parseValue(line[eq+1:])
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			value = v
+		}
+		key := section + "." + strings.ToLower(name)
+		c.values[key] = append(c.values[key], value)
+
+		if key == "include.path" && path != "" && depth < maxIncludeDepth {
+			include := value
+			if strings.HasPrefix(include, "~/") {
+				if home, err := os.UserHomeDir(); err == nil {
+					include = filepath.Join(home, include[2:])
+				}
+			}
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+			if err := c.readFile(include, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *Config) addSection(section string) {
+	for _, s := range c.sections {
+		if s == section {
+			return
+		}
+	}
+	c.sections = append(c.sections, section)
+}
+
+// parseSection parses a section header, returning the normalized name and
+// anything after the closing bracket.
+func parseSection(line string) (string, string, error) {
+	end := strings.IndexByte(line, ']')
+	if end < 0 {
+		return "", "", errSyntax
+	}
+	header := line[1:end]
+	rest := line[end+1:]
+
+	sp := strings.IndexAny(header, " \t")
+	if sp < 0 {
+		// Deprecated [section.subsection] syntax, which is case insensitive.
+		return strings.ToLower(header), rest, nil
+	}
+	name := strings.ToLower(header[:sp])
+	sub := strings.TrimSpace(header[sp:])
+	if len(sub) < 2 || sub[0] != '"' {
+		return "", "", errSyntax
+	}
+	// The closing bracket may have been inside the quotes.
+	if sub[len(sub)-1] != '"' || strings.HasSuffix(sub, "\\\"") {
+		end = strings.Index(line, "\"]")
+		if end < 0 {
+			return "", "", errSyntax
+		}
+		sub = strings.TrimSpace(line[1+sp : end+1])
+		rest = line[end+2:]
+	}
+	var b strings.Builder
+	for i := 1; i < len(sub)-1; i++ {
+		if sub[i] == '\\' && i+1 < len(sub)-1 {
+			i++
+		}
+		b.WriteByte(sub[i])
+	}
+	return name + "." + b.String(), rest, nil
+}
+
+// parseValue unquotes a value and strips comments.
+func parseValue(v string) (string, error) {
+	var b strings.Builder
+	quoted := false
+	v = strings.TrimSpace(v)
+	pendingSpace := ""
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		switch {
+		case ch == '"':
+			b.WriteString(pendingSpace)
+			pendingSpace = ""
+			quoted = !quoted
+		case ch == '\\':
+			if i+1 >= len(v) {
+				return "", errSyntax
+			}
+			i++
+			b.WriteString(pendingSpace)
+			pendingSpace = ""
+			switch v[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case '"', '\\':
+				b.WriteByte(v[i])
+			default:
+				return "", errSyntax
+			}
+		case !quoted && (ch == '#' || ch == ';'):
+			return b.String(), nil
+		case !quoted && (ch == ' ' || ch == '\t'):
+			// Whitespace is kept only between other characters.
+			pendingSpace += string(ch)
+		default:
+			b.WriteString(pendingSpace)
+			pendingSpace = ""
+			b.WriteByte(ch)
+		}
+	}
+	if quoted {
+		return "", errSyntax
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,165 @@
+package gitconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+# comment
+[core]
+	bare = false
+	IgnoreCase ; comment
+[branch "Feature/X"]
+	remote = origin
+	merge = refs/heads/feature/x # comment
+[remote.Origin]
+	url = "with  \"quotes\" # and hash"
+[alias]
+	a = first
+	a = second
+	multi = one \
+two
+	spaced =   inner   space   
+[section "sub]"] key = value
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key      string
+		expected string
+		ok       bool
+	}{
+		{key: "core.bare", expected: "false", ok: true},
+		{key: "CORE.BARE", expected: "false", ok: true},
+		{key: "core.ignorecase", expected: "true", ok: true},
+		{key: "branch.Feature/X.remote", expected: "origin", ok: true},
+		{key: "branch.feature/x.remote", ok: false},
+		{key: "branch.Feature/X.merge", expected: "refs/heads/feature/x", ok: true},
+		{key: "remote.origin.url", expected: `with  "quotes" # and hash`, ok: true},
+		{key: "alias.a", expected: "second", ok: true},
+		{key: "alias.multi", expected: "one two", ok: true},
+		{key: "alias.spaced", expected: "inner   space", ok: true},
+		{key: "section.sub].key", expected: "value", ok: true},
+		{key: "core.missing", ok: false},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			v, ok := c.Get(test.key)
+			if ok != test.ok || v != test.expected {
+				t.Errorf("Expected %q (%v), got %q (%v)", test.expected, test.ok, v, ok)
+			}
+		})
+	}
+
+	if v, ok := c.Bool("core.ignorecase"); !v || !ok {
+		t.Errorf("Expected core.ignorecase to be true")
+	}
+}
+
+func TestSubsections(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+[remote "origin"]
+	url = a
+[core]
+	bare = false
+[Remote "Upstream"]
+	url = b
+[remote "origin"]
+	fetch = c
+[remote.mirror]
+	url = d
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"origin", "Upstream", "mirror"}
+	if subs := c.Subsections("remote"); !reflect.DeepEqual(subs, expected) {
+		t.Errorf("Expected %q, got %q", expected, subs)
+	}
+	if subs := c.Subsections("core"); subs != nil {
+		t.Errorf("Expected no subsections, got %q", subs)
+	}
+}
+
+func TestSection(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+[gitprompt]
+	Format = first
+	format = second
+	disabled
+[gitprompt "sub"]
+	format = sub
+[Branch "Master"]
+	remote = origin
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"format": "second", "disabled": "true"}
+	if s := c.Section("GitPrompt"); !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected %q, got %q", expected, s)
+	}
+	expected = map[string]string{"remote": "origin"}
+	if s := c.Section("branch.Master"); !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected %q, got %q", expected, s)
+	}
+	if s := c.Section("branch.master"); len(s) != 0 {
+		t.Errorf("Expected empty section, got %q", s)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, config := range []string{
+		"key = value",
+		"[section\nkey = value",
+		"[section]\nkey = \"unterminated",
+		"[section]\nkey = \\x",
+	} {
+		if _, err := Parse(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected error for %q", config)
+		}
+	}
+}
+
+func TestReadFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitconfig-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("config", "[a]\n\tb = 1\n[include]\n\tpath = other\n[a]\n\tc = 3\n")
+	write("other", "[a]\n\tb = 2\n\tc = 2\n")
+
+	c, err := ReadFile(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("a.b"); v != "2" {
+		t.Errorf("Expected a.b from included file, got %q", v)
+	}
+	if v, _ := c.Get("a.c"); v != "3" {
+		t.Errorf("Expected a.c after include to win, got %q", v)
+	}
+
+	c, err = ReadFile(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("a.b"); ok {
+		t.Errorf("Expected empty config for missing file")
+	}
+}
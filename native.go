@@ -0,0 +1,735 @@
+package gitprompt
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/akupila/gitprompt/internal/gitconfig"
+)
+
+// ParseNative parses the status for the repository by reading the files in
+// .git directly instead of running git status, which is considerably faster
+// in large repositories. Returns nil if the current directory is not part of
+// a git repository.
+//
+// The result matches Parse with two exceptions: staged renames are only
+// detected if the content is unchanged, and files are compared without
+// applying filters such as line ending conversion. Git is still run to count
+// commits ahead and behind the upstream, and instead of reading the files if
+// the repository uses a feature that's not supported, such as split indexes.
+func ParseNative() (*GitStatus, error) {
+	return ParseWith(NativeSource{})
+}
+
+// NativeSource gets the status by reading the files in .git directly. See
+// ParseNative for how the result differs from ExecSource.
+type NativeSource struct {
+	// Dir is the directory to get the status for. Defaults to the current
+	// directory.
+	Dir string
+	// Files requests the list of changed files in GitStatus.Files.
+	Files bool
+	// Untracked is how untracked files are found.
+	Untracked UntrackedMode
+}
+
+// Status implements StatusSource.
+func (src NativeSource) Status(ctx context.Context) (*GitStatus, error) {
+	s, err := parseNative(ctx, src.dir(), src.Files, src.Untracked)
+	if err == errUnsupported {
+		return ExecSource{Dir: src.Dir, Files: src.Files, Untracked: src.Untracked}.Status(ctx)
+	}
+	return s, err
+}
+
+func (src NativeSource) dir() string {
+	if src.Dir == "" {
+		return "."
+	}
+	return src.Dir
+}
+
+// ParseHead reads the branch and sha from HEAD in the repository dir is part
+// of, leaving the other fields empty. It doesn't run git and is fast enough
+// to use as a fallback when getting the full status takes too long. Returns
+// nil if dir is not part of a git repository.
+func ParseHead(dir string) (*GitStatus, error) {
+	if dir == "" {
+		dir = "."
+	}
+	repo, err := findRepository(dir)
+	if repo == nil || err != nil {
+		return nil, err
+	}
+	branch, sha, err := repo.head()
+	if err != nil {
+		return nil, err
+	}
+	return &GitStatus{Branch: branch, Sha: sha}, nil
+}
+
+func parseNative(ctx context.Context, dir string, files bool, untracked UntrackedMode) (*GitStatus, error) {
+	repo, err := findRepository(dir)
+	if repo == nil || err != nil {
+		return nil, err
+	}
+	if err := repo.checkFormat(); err != nil {
+		return nil, err
+	}
+
+	r := &nativeReader{
+		ctx:     ctx,
+		repo:    repo,
+		status:  &GitStatus{},
+		changed: make(map[string]bool),
+
+		untrackedMode: untracked,
+	}
+	if files {
+		r.files = make(map[string]*FileStatus)
+	}
+	fileMode, ok, err := repo.configValue("core.filemode")
+	if err != nil {
+		return nil, err
+	}
+	r.fileMode = true
+	if b, valid := gitconfig.ParseBool(fileMode); ok && valid {
+		r.fileMode = b
+	}
+	if untracked == UntrackedNormal {
+		// Like git status, use status.showUntrackedFiles unless a mode
+		// is given.
+		if untracked, err = repo.showUntrackedFiles(); err != nil {
+			return nil, err
+		}
+		r.untrackedMode = untracked
+	}
+	if err := repo.checkRenames(); err != nil {
+		return nil, err
+	}
+	branch, sha, err := repo.head()
+	if err != nil {
+		return nil, err
+	}
+	r.status.Branch = branch
+	r.status.Sha = sha
+	if r.status.Stashes, err = repo.stashes(); err != nil {
+		return nil, err
+	}
+	r.status.Operation, r.status.Step, r.status.Steps = repo.operation()
+
+	indexFile := filepath.Join(repo.gitDir, "index")
+	if r.index, err = readIndex(indexFile); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(indexFile); err == nil {
+		r.indexTime = fi.ModTime()
+	}
+	r.objects, err = openObjectStore(filepath.Join(repo.commonDir, "objects"))
+	if err != nil {
+		return nil, err
+	}
+	defer r.objects.close()
+
+	r.conflicts = make(map[string]uint8)
+	for _, e := range r.index.entries {
+		if e.stage != 0 {
+			r.conflicts[e.path] |= 1 << uint(e.stage)
+		}
+	}
+	r.status.Conflicts = len(r.conflicts)
+	for p, stages := range r.conflicts {
+		if f := r.file(p, 0); f != nil {
+			f.Index = StateUnmerged
+			f.Worktree = StateUnmerged
+			f.Conflict = conflictStages[stages]
+		}
+	}
+
+	if err := r.countStaged(); err != nil {
+		return nil, err
+	}
+	if err := r.countModified(); err != nil {
+		return nil, err
+	}
+	if untracked != UntrackedNo {
+		if err := r.countUntracked(); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.countAheadBehind(); err != nil {
+		return nil, err
+	}
+	r.status.Changed = len(r.changed) + r.status.Conflicts + r.status.Untracked
+	r.listFiles()
+
+	return r.status, nil
+}
+
+// conflictStages maps the stages present in the index for an unmerged file
+// to the kind of conflict. Stage 1 is the common ancestor, 2 is ours and 3
+// is theirs.
+var conflictStages = map[uint8]ConflictType{
+	1<<1 | 1<<2 | 1<<3: BothModified,
+	1<<2 | 1<<3:        BothAdded,
+	1<<1 | 1<<2:        DeletedByThem,
+	1<<1 | 1<<3:        DeletedByUs,
+	1 << 2:             AddedByUs,
+	1 << 3:             AddedByThem,
+	1 << 1:             BothDeleted,
+}
+
+// nativeReader computes the status from the files in a repository.
+type nativeReader struct {
+	ctx       context.Context
+	repo      *repository
+	index     *index
+	indexTime time.Time
+	objects   *objectStore
+	// conflicts holds the stages in the index of each unmerged file as a
+	// bit mask.
+	conflicts map[string]uint8
+	status    *GitStatus
+
+	// files holds the changed files if they were requested, nil otherwise.
+	files map[string]*FileStatus
+	// changed holds the staged and modified files.
+	changed   map[string]bool
+	untracked []string
+	// untrackedMode is how untracked files are found.
+	untrackedMode UntrackedMode
+	// fileMode is false if core.fileMode is, and changes to the executable
+	// bit are ignored.
+	fileMode bool
+
+	tracked     map[string]bool
+	trackedDirs map[string]bool
+}
+
+// countStaged compares the index to the tree of the HEAD commit.
+func (r *nativeReader) countStaged() error {
+	head := make(map[string]treeEntry)
+	// Directories that are known to be the same in the index and HEAD don't
+	// need to be compared.
+	same := make(map[string]bool)
+	if r.status.Sha != "" {
+		var commit [20]byte
+		if _, err := hex.Decode(commit[:], []byte(r.status.Sha)); err != nil {
+			return err
+		}
+		tree, err := r.objects.commitTree(commit)
+		if err != nil {
+			return err
+		}
+		if err := r.readHeadTree(tree, "", head, same); err != nil {
+			return err
+		}
+	}
+
+	var added []indexEntry
+	for _, e := range r.index.entries {
+		if e.stage != 0 || e.intentToAdd || inDirs(e.path, same) {
+			continue
+		}
+		h, ok := head[e.path]
+		delete(head, e.path)
+		if !ok {
+			added = append(added, e)
+			continue
+		}
+		if h.mode&modeTypeMask != e.mode&modeTypeMask {
+			r.staged(e.path, e.mode, StateTypeChanged)
+		} else if h.sha != e.sha || h.mode != e.mode {
+			r.staged(e.path, e.mode, StateModified)
+		}
+	}
+
+	// Files with the same content that were removed and added are counted
+	// once as a rename.
+	deleted := make(map[[20]byte][]string)
+	for p, h := range head {
+		if _, ok := r.conflicts[p]; ok {
+			continue
+		}
+		deleted[h.sha] = append(deleted[h.sha], p)
+	}
+	for _, paths := range deleted {
+		sort.Strings(paths)
+	}
+	for _, e := range added {
+		if paths := deleted[e.sha]; len(paths) > 0 {
+			deleted[e.sha] = paths[1:]
+			if f := r.staged(e.path, e.mode, StateRenamed); f != nil {
+				f.OrigPath = paths[0]
+			}
+			continue
+		}
+		r.staged(e.path, e.mode, StateAdded)
+	}
+	for _, paths := range deleted {
+		for _, p := range paths {
+			r.staged(p, head[p].mode, StateDeleted)
+		}
+	}
+	return nil
+}
+
+// staged counts a change between HEAD and the index. Returns the file if
+// files were requested.
+func (r *nativeReader) staged(path string, mode uint32, state FileState) *FileStatus {
+	r.status.Staged++
+	r.status.Index.count(state)
+	r.changed[path] = true
+	f := r.file(path, mode)
+	if f != nil {
+		f.Index = state
+	}
+	return f
+}
+
+// modified counts a change between the index and the working tree.
+func (r *nativeReader) modified(path string, mode uint32, state FileState) {
+	r.status.Modified++
+	r.status.Worktree.count(state)
+	r.changed[path] = true
+	if f := r.file(path, mode); f != nil {
+		f.Worktree = state
+	}
+}
+
+// file returns the status of the file, or nil if files were not requested.
+func (r *nativeReader) file(path string, mode uint32) *FileStatus {
+	if r.files == nil {
+		return nil
+	}
+	f, ok := r.files[path]
+	if !ok {
+		f = &FileStatus{
+			Path:      path,
+			Index:     StateUnmodified,
+			Worktree:  StateUnmodified,
+			Submodule: mode&modeTypeMask == modeGitlink,
+		}
+		r.files[path] = f
+	}
+	return f
+}
+
+// listFiles sets the files in the status in the same order as git status:
+// changed files by path, then unmerged files and untracked files last.
+func (r *nativeReader) listFiles() {
+	if r.files == nil {
+		return
+	}
+	var files []FileStatus
+	for _, f := range r.files {
+		files = append(files, *f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		ui, uj := files[i].Index == StateUnmerged, files[j].Index == StateUnmerged
+		if ui != uj {
+			return uj
+		}
+		return files[i].Path < files[j].Path
+	})
+	sort.Strings(r.untracked)
+	r.status.Files = files
+	for _, p := range r.untracked {
+		r.status.Files = append(r.status.Files, FileStatus{
+			Path:     p,
+			Index:    StateUntracked,
+			Worktree: StateUntracked,
+		})
+	}
+}
+
+// readHeadTree adds the files in the tree to files, skipping directories
+// that are unchanged in the index's cached trees.
+func (r *nativeReader) readHeadTree(sha [20]byte, dir string, files map[string]treeEntry, same map[string]bool) error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if cached, ok := r.index.trees[dir]; ok && cached == sha {
+		same[dir] = true
+		return nil
+	}
+	entries, err := r.objects.readTree(sha)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := e.name
+		if dir != "" {
+			p = dir + "/" + e.name
+		}
+		if e.mode&modeTypeMask == modeTree {
+			if err := r.readHeadTree(e.sha, p, files, same); err != nil {
+				return err
+			}
+			continue
+		}
+		files[p] = e
+	}
+	return nil
+}
+
+// inDirs returns true if the path is inside any of the directories.
+func inDirs(p string, dirs map[string]bool) bool {
+	if len(dirs) == 0 {
+		return false
+	}
+	if dirs[""] {
+		return true
+	}
+	for i := strings.LastIndexByte(p, '/'); i > 0; i = strings.LastIndexByte(p[:i], '/') {
+		if dirs[p[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+// countModified compares the index to the files in the working tree.
+func (r *nativeReader) countModified() error {
+	for _, e := range r.index.entries {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if e.stage != 0 || e.skipWorktree || e.assumeValid {
+			continue
+		}
+		if e.intentToAdd {
+			r.modified(e.path, e.mode, StateAdded)
+			continue
+		}
+		state, err := r.worktreeChange(e)
+		if err != nil {
+			return err
+		}
+		if state != StateUnmodified {
+			r.modified(e.path, e.mode, state)
+		}
+	}
+	return nil
+}
+
+// worktreeChange returns the state of the change to the file in the
+// working tree, or StateUnmodified if it's unchanged.
+func (r *nativeReader) worktreeChange(e indexEntry) (FileState, error) {
+	file := filepath.Join(r.repo.workTree, filepath.FromSlash(e.path))
+	fi, err := os.Lstat(file)
+	if err != nil {
+		if os.IsNotExist(err) || isNotDir(err) {
+			return StateDeleted, nil
+		}
+		return StateUnmodified, err
+	}
+
+	switch e.mode & modeTypeMask {
+	case modeGitlink:
+		// Changes inside submodules are not detected.
+		if !fi.IsDir() {
+			return StateTypeChanged, nil
+		}
+		return StateUnmodified, nil
+	case modeSymlink:
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return StateTypeChanged, nil
+		}
+	default:
+		if fi.IsDir() {
+			return StateDeleted, nil
+		}
+		if !fi.Mode().IsRegular() {
+			return StateTypeChanged, nil
+		}
+		if r.fileMode && (fi.Mode()&0100 != 0) != (e.mode&0100 != 0) {
+			return StateModified, nil
+		}
+	}
+	if uint32(fi.Size()) != e.size {
+		return StateModified, nil
+	}
+
+	// If the file was written after the index it may have changed without
+	// affecting the timestamp.
+	mtime := fi.ModTime()
+	racy := !mtime.Before(r.indexTime)
+	if !racy && uint32(mtime.Unix()) == e.mtime && uint32(mtime.Nanosecond()) == e.mtimeNano {
+		return StateUnmodified, nil
+	}
+
+	var sha [20]byte
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(file)
+		if err != nil {
+			return StateUnmodified, err
+		}
+		sha, err = hashBlob(strings.NewReader(target), int64(len(target)))
+		if err != nil {
+			return StateUnmodified, err
+		}
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return StateUnmodified, err
+		}
+		sha, err = hashBlob(f, fi.Size())
+		_ = f.Close()
+		if err != nil {
+			return StateUnmodified, err
+		}
+	}
+	if sha != e.sha {
+		return StateModified, nil
+	}
+	return StateUnmodified, nil
+}
+
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+// countUntracked walks the working tree looking for files that are not in
+// the index or ignored. Like git status, a directory with no tracked files is
+// counted once.
+func (r *nativeReader) countUntracked() error {
+	r.tracked = make(map[string]bool, len(r.index.entries))
+	r.trackedDirs = map[string]bool{"": true}
+	for _, e := range r.index.entries {
+		r.tracked[e.path] = true
+		for i := strings.LastIndexByte(e.path, '/'); i > 0; i = strings.LastIndexByte(e.path[:i], '/') {
+			if r.trackedDirs[e.path[:i]] {
+				break
+			}
+			r.trackedDirs[e.path[:i]] = true
+		}
+	}
+
+	excludesFile, err := r.repo.excludesFile()
+	if err != nil {
+		return err
+	}
+	m := &ignoreMatcher{}
+	for _, file := range []string{
+		excludesFile,
+		filepath.Join(r.repo.commonDir, "info", "exclude"),
+	} {
+		l, err := openIgnoreFile(file, "")
+		if err != nil {
+			return err
+		}
+		m = m.with(l)
+	}
+
+	n, err := r.walkUntracked("", m)
+	r.status.Untracked = n
+	return err
+}
+
+func (r *nativeReader) walkUntracked(dir string, m *ignoreMatcher) (int, error) {
+	m, entries, err := r.readDir(dir, m)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range entries {
+		p := fi.Name()
+		if dir != "" {
+			p = dir + "/" + p
+		}
+		if dir == "" && fi.Name() == ".git" || r.tracked[p] || m.ignored(p, fi.IsDir()) {
+			continue
+		}
+		if !fi.IsDir() {
+			r.untrackedFile(p)
+			n++
+			continue
+		}
+		if r.trackedDirs[p] || r.untrackedMode == UntrackedAll && !r.isRepository(p) {
+			c, err := r.walkUntracked(p, m)
+			if err != nil {
+				return 0, err
+			}
+			n += c
+			continue
+		}
+		found, err := r.hasUntracked(p, m)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			r.untrackedFile(p + "/")
+			n++
+		}
+	}
+	return n, nil
+}
+
+// isRepository returns true if the directory in the working tree is a nested
+// repository.
+func (r *nativeReader) isRepository(dir string) bool {
+	_, err := os.Stat(filepath.Join(r.repo.workTree, filepath.FromSlash(dir), ".git"))
+	return err == nil
+}
+
+// untrackedFile records the untracked path if files were requested.
+func (r *nativeReader) untrackedFile(path string) {
+	if r.files != nil {
+		r.untracked = append(r.untracked, path)
+	}
+}
+
+// hasUntracked returns true if the untracked directory contains any files
+// that are not ignored.
+func (r *nativeReader) hasUntracked(dir string, m *ignoreMatcher) (bool, error) {
+	m, entries, err := r.readDir(dir, m)
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range entries {
+		if fi.Name() == ".git" {
+			// Nested repository.
+			return true, nil
+		}
+	}
+	for _, fi := range entries {
+		p := dir + "/" + fi.Name()
+		if m.ignored(p, fi.IsDir()) {
+			continue
+		}
+		if !fi.IsDir() {
+			return true, nil
+		}
+		found, err := r.hasUntracked(p, m)
+		if found || err != nil {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// readDir lists the directory in the working tree, adding the patterns in
+// its .gitignore to the matcher.
+func (r *nativeReader) readDir(dir string, m *ignoreMatcher) (*ignoreMatcher, []os.FileInfo, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	abs := filepath.Join(r.repo.workTree, filepath.FromSlash(dir))
+	l, err := openIgnoreFile(filepath.Join(abs, ".gitignore"), dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := ioutil.ReadDir(abs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.with(l), entries, nil
+}
+
+// excludesFile returns the file set in core.excludesFile, or the default
+// $XDG_CONFIG_HOME/git/ignore.
+func (r *repository) excludesFile() (string, error) {
+	file, ok, err := r.configValue("core.excludesfile")
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		file = expandHome(file)
+		if file != "" && !filepath.IsAbs(file) {
+			// git runs status from the top of the working tree.
+			file = filepath.Join(r.workTree, file)
+		}
+		return file, nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "git", "ignore"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", nil
+	}
+	return filepath.Join(home, ".config", "git", "ignore"), nil
+}
+
+// showUntrackedFiles returns the mode set in status.showUntrackedFiles.
+func (r *repository) showUntrackedFiles() (UntrackedMode, error) {
+	v, ok, err := r.configValue("status.showuntrackedfiles")
+	if !ok || err != nil {
+		return UntrackedNormal, err
+	}
+	switch strings.ToLower(v) {
+	case "normal":
+		return UntrackedNormal, nil
+	case "no":
+		return UntrackedNo, nil
+	case "all":
+		return UntrackedAll, nil
+	}
+	if b, valid := gitconfig.ParseBool(v); valid {
+		if b {
+			return UntrackedNormal, nil
+		}
+		return UntrackedNo, nil
+	}
+	return UntrackedNormal, errUnsupported
+}
+
+// checkRenames returns errUnsupported if status.renames or diff.renames turn
+// off rename detection or detect copies, which the native reader doesn't.
+func (r *repository) checkRenames() error {
+	for _, key := range []string{"status.renames", "diff.renames"} {
+		v, ok, err := r.configValue(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if b, valid := gitconfig.ParseBool(v); valid && b {
+			return nil
+		}
+		return errUnsupported
+	}
+	return nil
+}
+
+// countAheadBehind reads the upstream from the config, then runs git to count
+// the commits ahead and behind it, as walking the history is not worth doing
+// natively.
+func (r *nativeReader) countAheadBehind() error {
+	if r.status.Branch == "" {
+		return nil
+	}
+	upstream, exists, err := r.repo.upstream(r.status.Branch)
+	if err != nil {
+		return err
+	}
+	r.status.Upstream = upstream
+	r.status.UpstreamGone = upstream != "" && !exists
+	if !exists || r.status.Sha == "" {
+		return nil
+	}
+	out, err := runGitCommand(r.ctx, r.repo.workTree, "git", "rev-list", "--left-right", "--count", "HEAD...@{upstream}")
+	if err != nil {
+		return err
+	}
+	parts := strings.Fields(out)
+	if len(parts) != 2 {
+		return nil
+	}
+	r.status.Ahead, _ = strconv.Atoi(parts[0])
+	r.status.Behind, _ = strconv.Atoi(parts[1])
+	return nil
+}
@@ -0,0 +1,622 @@
+package gitprompt
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNative(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup string
+	}{
+		{
+			name: "not git repo",
+		},
+		{
+			name: "empty",
+			setup: `
+				git init
+			`,
+		},
+		{
+			name: "untracked",
+			setup: `
+				git init
+				touch a b
+				mkdir -p dir/sub
+				touch dir/sub/c dir/d
+			`,
+		},
+		{
+			name: "untracked in tracked dir",
+			setup: `
+				git init
+				mkdir -p dir/sub
+				touch dir/tracked dir/sub/tracked
+				git add .
+				git commit -m 'initial'
+				touch dir/a dir/sub/b
+				mkdir dir/new
+				touch dir/new/c
+			`,
+		},
+		{
+			name: "ignored",
+			setup: `
+				git init
+				printf 'ignored\n*.log\n/root-only\nbuild/\n!keep.log\n' > .gitignore
+				mkdir -p dir/build sub/root-only only-ignored
+				touch ignored dir/ignored a.log keep.log dir/b.log root-only sub/root-only/x dir/build/x
+				touch only-ignored/a.log
+				echo 'excluded' > .git/info/exclude
+				touch excluded
+				printf '*.txt\n' > dir/.gitignore
+				touch dir/a.txt a.txt
+			`,
+		},
+		{
+			name: "staged",
+			setup: `
+				git init
+				echo a > a
+				echo b > b
+				echo c > c
+				git add .
+				git commit -m 'initial'
+				echo aa > a
+				git rm b
+				touch d
+				git add a d
+			`,
+		},
+		{
+			name: "staged initial",
+			setup: `
+				git init
+				mkdir dir
+				touch a dir/b
+				git add .
+			`,
+		},
+		{
+			name: "renamed",
+			setup: `
+				git init
+				mkdir dir
+				echo a > dir/a
+				git add .
+				git commit -m 'initial'
+				git mv dir/a b
+			`,
+		},
+		{
+			name: "modified",
+			setup: `
+				git init
+				echo hello > a
+				echo hello > b
+				echo hello > c
+				echo hello > d
+				ln -s a link
+				git add .
+				git commit -m 'initial'
+				echo world > a
+				rm b
+				chmod +x c
+				ln -sf b link
+			`,
+		},
+		{
+			name: "directory replaced file",
+			setup: `
+				git init
+				touch a
+				git add a
+				git commit -m 'initial'
+				rm a
+				mkdir a
+				touch a/b
+			`,
+		},
+		{
+			name: "staged and modified",
+			setup: `
+				git init
+				echo a > a
+				git add .
+				git commit -m 'initial'
+				echo b >> a
+				git add a
+				echo c >> a
+			`,
+		},
+		{
+			name: "intent to add",
+			setup: `
+				git init
+				git commit --allow-empty -m 'initial'
+				touch a
+				git add -N a
+			`,
+		},
+		{
+			name: "conflicts",
+			setup: `
+				git init
+				git commit --allow-empty -m 'initial'
+				git checkout -b other
+				git checkout master
+				echo foo >> test
+				git add test
+				git commit -m 'first'
+				git checkout other
+				echo bar >> test
+				git add test
+				git commit -m 'first'
+				git rebase master || true
+			`,
+		},
+		{
+			name: "packed",
+			setup: `
+				git init
+				mkdir -p dir/sub
+				for i in 1 2 3 4 5; do
+					seq 1 100 > dir/sub/file$i
+					git add .
+					git commit -m "commit $i"
+				done
+				git gc --aggressive -q
+				git pack-refs --all
+				echo changed > dir/sub/file1
+				git add dir/sub/file1
+				echo changed > dir/sub/file2
+			`,
+		},
+		{
+			name: "index version 4",
+			setup: `
+				git init
+				mkdir -p dir/sub
+				touch dir/sub/a dir/sub/b dir/c
+				git add .
+				git commit -m 'initial'
+				git update-index --index-version 4
+				echo a > dir/sub/a
+				git add dir/sub/a
+				rm dir/c
+			`,
+		},
+		{
+			name: "stashes",
+			setup: `
+				git init
+				git commit --allow-empty -m 'initial'
+				touch a
+				git add a
+				git stash
+				touch b
+				git stash push -u -- b
+			`,
+		},
+		{
+			name: "file mode ignored",
+			setup: `
+				git init
+				touch a b
+				git add .
+				git commit -m 'initial'
+				git config core.fileMode false
+				chmod +x a
+			`,
+		},
+		{
+			name: "show untracked files no",
+			setup: `
+				git init
+				git config status.showUntrackedFiles no
+				mkdir dir
+				touch a dir/b
+			`,
+		},
+		{
+			name: "show untracked files all",
+			setup: `
+				git init
+				git config status.showUntrackedFiles all
+				mkdir dir
+				touch a dir/b dir/c
+			`,
+		},
+		{
+			name: "copies",
+			setup: `
+				git init
+				git config status.renames copies
+				seq 1 100 > a
+				git add a
+				git commit -m 'initial'
+				cp a b
+				echo 101 >> a
+				git add a b
+			`,
+		},
+		{
+			name: "excludes file",
+			setup: `
+				git init
+				echo '*.log' > ../excludes
+				git config core.excludesFile "$PWD/../excludes"
+				touch a.log b
+			`,
+		},
+		{
+			name: "negated class",
+			setup: `
+				git init
+				echo '[!a].log' > .gitignore
+				touch a.log b.log c
+			`,
+		},
+		{
+			name: "detached",
+			setup: `
+				git init
+				git commit --allow-empty -m 'first'
+				git commit --allow-empty -m 'second'
+				git checkout HEAD^
+			`,
+		},
+		{
+			name: "ahead and behind",
+			setup: `
+				git init
+				git remote add origin $REMOTE
+				git commit --allow-empty -m 'first'
+				git commit --allow-empty -m 'second'
+				git push -u origin HEAD
+				git reset --hard HEAD^
+				git commit --allow-empty -m 'third'
+			`,
+		},
+		{
+			name: "upstream gone",
+			setup: `
+				git init
+				git remote add origin $REMOTE
+				git commit --allow-empty -m 'first'
+				git push -u origin HEAD
+				git pack-refs --all
+				git branch -r -d origin/master
+			`,
+		},
+		{
+			name: "local upstream",
+			setup: `
+				git init
+				git commit --allow-empty -m 'first'
+				git branch base
+				git branch --set-upstream-to=base
+				git commit --allow-empty -m 'second'
+			`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, cleanupDir := setupTestDir(t)
+			defer cleanupDir()
+
+			if test.setup != "" {
+				remote, cleanupRemote := setupRemote(t, dir)
+				defer cleanupRemote()
+				commands := "export REMOTE=" + remote + "\n" + test.setup
+				setupCommands(t, dir, commands)
+			}
+
+			assertNativeMatches(t)
+		})
+	}
+}
+
+func TestParseNativeWorktree(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		mkdir main
+		cd main
+		git init
+		touch a b
+		git add .
+		git commit -m 'initial'
+		git worktree add ../linked
+		cd ../linked
+		echo a > a
+		git add a
+		touch c
+		git pack-refs --all
+	`)
+	if err := os.Chdir(filepath.Join(dir, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	assertNativeMatches(t)
+}
+
+func TestParseNativeSubdir(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		mkdir -p dir/sub
+		touch dir/sub/a b
+	`)
+	if err := os.Chdir(filepath.Join(dir, "dir", "sub")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ParseNative()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertString(t, "branch", "master", s.Branch)
+	assertInt(t, "Untracked", 2, s.Untracked)
+}
+
+func TestNativeSourceDir(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		touch a
+		git add a
+		touch b
+	`)
+	if err := os.Chdir(os.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NativeSource{Dir: dir}.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertString(t, "branch", "master", s.Branch)
+	assertInt(t, "Staged", 1, s.Staged)
+	assertInt(t, "Untracked", 1, s.Untracked)
+}
+
+// assertNativeMatches asserts that ParseNative returns the same status as
+// Parse in the current directory.
+func assertNativeMatches(t *testing.T) {
+	t.Helper()
+	expected, err := Parse()
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	actual, err := ParseNative()
+	if err != nil {
+		t.Fatalf("ParseNative: %v", err)
+	}
+	if expected == nil {
+		if actual != nil {
+			t.Errorf("Expected nil return, got %v", actual)
+		}
+		return
+	}
+	if actual == nil {
+		t.Fatalf("Expected %v, got nil", expected)
+	}
+	assertString(t, "Branch", expected.Branch, actual.Branch)
+	assertString(t, "Sha", expected.Sha, actual.Sha)
+	assertInt(t, "Untracked", expected.Untracked, actual.Untracked)
+	assertInt(t, "Modified", expected.Modified, actual.Modified)
+	assertInt(t, "Staged", expected.Staged, actual.Staged)
+	assertInt(t, "Conflicts", expected.Conflicts, actual.Conflicts)
+	assertInt(t, "Ahead", expected.Ahead, actual.Ahead)
+	assertInt(t, "Behind", expected.Behind, actual.Behind)
+	if actual.Index != expected.Index {
+		t.Errorf("Index does not match\n\tExpected: %+v\n\tActual:   %+v", expected.Index, actual.Index)
+	}
+	if actual.Worktree != expected.Worktree {
+		t.Errorf("Worktree does not match\n\tExpected: %+v\n\tActual:   %+v", expected.Worktree, actual.Worktree)
+	}
+	assertInt(t, "Stashes", expected.Stashes, actual.Stashes)
+	assertInt(t, "Changed", expected.Changed, actual.Changed)
+	assertString(t, "Upstream", expected.Upstream, actual.Upstream)
+	assertBool(t, "UpstreamGone", expected.UpstreamGone, actual.UpstreamGone)
+
+	expected, err = ParseWith(ExecSource{Files: true})
+	if err != nil {
+		t.Fatalf("Parse files: %v", err)
+	}
+	actual, err = ParseWith(NativeSource{Files: true})
+	if err != nil {
+		t.Fatalf("ParseNative files: %v", err)
+	}
+	if !reflect.DeepEqual(actual.Files, expected.Files) {
+		t.Errorf("Files does not match\n\tExpected: %+v\n\tActual:   %+v", expected.Files, actual.Files)
+	}
+}
+
+func TestParseNativeGlobalConfig(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		mkdir repo
+		cd repo
+		git init
+		touch a.log b.tmp c
+	`)
+	global := filepath.Join(dir, "gitconfig")
+	defer os.Setenv("GIT_CONFIG_GLOBAL", os.Getenv("GIT_CONFIG_GLOBAL"))
+	os.Setenv("GIT_CONFIG_GLOBAL", global)
+	if err := os.Chdir(filepath.Join(dir, "repo")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("excludes", "*.log\n")
+	writeFile("gitconfig", "[core]\n\texcludesFile = "+filepath.Join(dir, "excludes")+"\n")
+	assertNativeMatches(t)
+
+	// Conditional includes are not evaluated, so the native reader falls
+	// back to git.
+	writeFile("work", "[core]\n\texcludesFile = "+filepath.Join(dir, "work-excludes")+"\n")
+	writeFile("work-excludes", "*.tmp\n")
+	writeFile("gitconfig", "[includeIf \"gitdir:"+dir+"/\"]\n\tpath = work\n")
+	if _, err := parseNative(context.Background(), ".", false, UntrackedNormal); err != errUnsupported {
+		t.Errorf("Expected errUnsupported, got %v", err)
+	}
+	assertNativeMatches(t)
+}
+
+func TestPackLimits(t *testing.T) {
+	f, err := ioutil.TempFile("", "gitprompt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// A blob claiming to be 512MB.
+	if _, err := f.Write([]byte{0xbf, 0xff, 0xff, 0xff, 0x0f}); err != nil {
+		t.Fatal(err)
+	}
+	p := &pack{file: f, bases: make(map[int64]packObject)}
+	if _, _, err := p.read(0, &objectStore{}, 0); err != errUnsupported {
+		t.Errorf("Expected errUnsupported for a huge object, got %v", err)
+	}
+
+	// The delta claims a 512MB result.
+	if _, err := applyDelta(nil, []byte{0x00, 0x80, 0x80, 0x80, 0x80, 0x02}); err != errUnsupported {
+		t.Errorf("Expected errUnsupported for a huge delta, got %v", err)
+	}
+
+	// The delta inserts more than the result size it claims.
+	if _, err := applyDelta(nil, []byte{0x00, 0x01, 0x02, 'a', 'b'}); err != errDeltaCorrupt {
+		t.Errorf("Expected errDeltaCorrupt for a delta larger than its size, got %v", err)
+	}
+
+	// Missing objects may be in a partial clone.
+	if _, _, err := (&objectStore{}).read([20]byte{1}); err != errUnsupported {
+		t.Errorf("Expected errUnsupported for a missing object, got %v", err)
+	}
+
+	obj := packObject{typ: objTree, data: make([]byte, maxCachedBases/3)}
+	for off := int64(0); off < 10; off++ {
+		p.cache(off, obj)
+		if p.cached > maxCachedBases {
+			t.Fatalf("Expected at most %d bytes cached, got %d", maxCachedBases, p.cached)
+		}
+	}
+	if _, ok := p.bases[9]; !ok {
+		t.Errorf("Expected the last object to be cached")
+	}
+}
+
+func TestPackFind(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		for i in $(seq 20); do echo $i > $i; git add $i; git commit -q -m $i; done
+		git gc -q
+	`)
+	out, err := exec.Command("git", "rev-parse", "HEAD", "HEAD~10^{tree}").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commit, tree [20]byte
+	lines := strings.Fields(string(out))
+	if _, err := hex.Decode(commit[:], []byte(lines[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hex.Decode(tree[:], []byte(lines[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openObjectStore(filepath.Join(dir, ".git", "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if len(s.packs) != 1 || s.packs[0].idx != nil {
+		t.Fatalf("Expected one pack that's not opened yet, got %d", len(s.packs))
+	}
+	if _, err := s.commitTree(commit); err != nil {
+		t.Errorf("Received unexpected error reading the commit: %v", err)
+	}
+	if entries, err := s.readTree(tree); err != nil || len(entries) != 10 {
+		t.Errorf("Expected 10 entries in the tree, got %d, %v", len(entries), err)
+	}
+	if _, ok, err := s.packs[0].find([20]byte{0xff, 0xff}); ok || err != nil {
+		t.Errorf("Expected a missing object not to be found, got %v, %v", ok, err)
+	}
+}
+
+func TestPackDeltaLoops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitprompt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sha := [20]byte{0x12, 0x34}
+	// writePack writes a pack with a single object at offset 12, after the
+	// header, and an index pointing sha to it.
+	writePack := func(name string, object []byte) {
+		t.Helper()
+		packData := append([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x01"), object...)
+		idx := []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}
+		for i := 0; i < 256; i++ {
+			n := byte(0)
+			if i >= int(sha[0]) {
+				n = 1
+			}
+			idx = append(idx, 0, 0, 0, n)
+		}
+		idx = append(idx, sha[:]...)
+		idx = append(idx, 0, 0, 0, 0)  // CRC32
+		idx = append(idx, 0, 0, 0, 12) // offset
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".pack"), packData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".idx"), idx, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An ofs delta whose base is itself.
+	writePack("ofs", []byte{objOfsDelta<<4 | 1, 0x00})
+	p := newPack(filepath.Join(dir, "ofs.idx"))
+	defer p.close()
+	off, ok, err := p.find(sha)
+	if !ok || err != nil {
+		t.Fatalf("Expected the object to be found, got %v, %v", ok, err)
+	}
+	if _, _, err := p.read(off, &objectStore{}, 0); err == nil {
+		t.Errorf("Expected an error for a delta against itself")
+	}
+
+	// A ref delta whose base is itself.
+	writePack("ref", append([]byte{objRefDelta<<4 | 1}, sha[:]...))
+	s := &objectStore{packs: []*pack{newPack(filepath.Join(dir, "ref.idx"))}}
+	defer s.close()
+	if _, _, err := s.read(sha); err == nil {
+		t.Errorf("Expected an error for a delta against itself")
+	}
+}
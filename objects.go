@@ -0,0 +1,562 @@
+package gitprompt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+// maxObjectSize is the largest object that is read. Only commits and trees
+// are read, which are far smaller, so a larger size is likely a corrupt pack
+// that would otherwise use all memory.
+const maxObjectSize = 64 << 20
+
+// maxCachedBases limits the size of the objects cached by a pack.
+const maxCachedBases = 32 << 20
+
+// maxDeltaDepth is the longest chain of deltas that is resolved, the most git
+// writes. A longer chain is likely a corrupt pack with deltas that refer back
+// to themselves.
+const maxDeltaDepth = 4095
+
+// objectStore reads objects from the loose object directories and pack files
+// of a repository.
+type objectStore struct {
+	dirs  []string
+	packs []*pack
+}
+
+func openObjectStore(objectsDir string) (*objectStore, error) {
+	s := &objectStore{}
+	if err := s.addDir(objectsDir, 0); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *objectStore) addDir(dir string, depth int) error {
+	s.dirs = append(s.dirs, dir)
+
+	idxFiles, err := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+	if err != nil {
+		return err
+	}
+	for _, idxFile := range idxFiles {
+		s.packs = append(s.packs, newPack(idxFile))
+	}
+
+	// Objects may be borrowed from other repositories, such as in clones
+	// made with --shared or --reference.
+	if depth >= 5 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		if err := s.addDir(line, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *objectStore) close() {
+	for _, p := range s.packs {
+		p.close()
+	}
+}
+
+// read returns the type and contents of the object.
+func (s *objectStore) read(sha [20]byte) (int, []byte, error) {
+	return s.readDelta(sha, 0)
+}
+
+// readDelta reads the object as the base of a delta depth deltas deep.
+func (s *objectStore) readDelta(sha [20]byte, depth int) (int, []byte, error) {
+	hexSha := hex.EncodeToString(sha[:])
+	for _, dir := range s.dirs {
+		t, data, err := readLooseObject(filepath.Join(dir, hexSha[:2], hexSha[2:]))
+		if os.IsNotExist(err) {
+			continue
+		}
+		return t, data, err
+	}
+	for _, p := range s.packs {
+		off, ok, err := p.find(sha)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			continue
+		}
+		return p.read(off, s, depth)
+	}
+	// Objects can be missing from partial clones, git fetches them when
+	// needed.
+	return 0, nil, errUnsupported
+}
+
+// commitTree returns the sha of the tree of a commit.
+func (s *objectStore) commitTree(sha [20]byte) ([20]byte, error) {
+	var tree [20]byte
+	t, data, err := s.read(sha)
+	if err != nil {
+		return tree, err
+	}
+	if t != objCommit || !bytes.HasPrefix(data, []byte("tree ")) || len(data) < 45 {
+		return tree, fmt.Errorf("object %x is not a commit", sha)
+	}
+	_, err = hex.Decode(tree[:], data[5:45])
+	return tree, err
+}
+
+// treeEntry is an entry in a tree object.
+type treeEntry struct {
+	name string
+	mode uint32
+	sha  [20]byte
+}
+
+// readTree returns the entries in a tree object.
+func (s *objectStore) readTree(sha [20]byte) ([]treeEntry, error) {
+	t, data, err := s.read(sha)
+	if err != nil {
+		return nil, err
+	}
+	if t != objTree {
+		return nil, fmt.Errorf("object %x is not a tree", sha)
+	}
+	var entries []treeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return nil, fmt.Errorf("tree %x corrupt", sha)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("tree %x corrupt: %v", sha, err)
+		}
+		data = data[sp+1:]
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || nul+21 > len(data) {
+			return nil, fmt.Errorf("tree %x corrupt", sha)
+		}
+		e := treeEntry{
+			name: string(data[:nul]),
+			mode: uint32(mode),
+		}
+		copy(e.sha[:], data[nul+1:nul+21])
+		entries = append(entries, e)
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
+
+func readLooseObject(path string) (int, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	zr, err := zlib.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(zr, maxObjectSize+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) > maxObjectSize {
+		return 0, nil, errUnsupported
+	}
+	nul := bytes.IndexByte(b, 0)
+	if nul < 0 {
+		return 0, nil, fmt.Errorf("object %s corrupt", path)
+	}
+	header := strings.SplitN(string(b[:nul]), " ", 2)
+	var t int
+	switch header[0] {
+	case "commit":
+		t = objCommit
+	case "tree":
+		t = objTree
+	case "blob":
+		t = objBlob
+	case "tag":
+		t = objTag
+	default:
+		return 0, nil, fmt.Errorf("object %s has unknown type %q", path, header[0])
+	}
+	return t, b[nul+1:], nil
+}
+
+// pack is a pack file and its index. Both are opened the first time an object
+// is looked up, and the index is searched on disk rather than read whole, as
+// only a few objects are needed from indexes that can be hundreds of MB.
+type pack struct {
+	idxFile string
+	idx     *os.File
+	// size is the size of the index.
+	size   int64
+	fanout [256]uint32
+	// shas, offsets and large are where the tables start in the index.
+	shas    int64
+	offsets int64
+	large   int64
+
+	file *os.File
+	// bases caches objects that have been read, keyed by offset, as the
+	// same delta bases are needed for many objects. cached is the size of
+	// the objects in it.
+	bases  map[int64]packObject
+	cached int
+}
+
+type packObject struct {
+	typ  int
+	data []byte
+}
+
+func newPack(idxFile string) *pack {
+	return &pack{
+		idxFile: idxFile,
+		bases:   make(map[int64]packObject),
+	}
+}
+
+// open opens the index and the pack file if they're not open yet.
+func (p *pack) open() error {
+	if p.idx != nil {
+		return nil
+	}
+	idx, err := os.Open(p.idxFile)
+	if err != nil {
+		return err
+	}
+	if err := p.readHeader(idx); err != nil {
+		_ = idx.Close()
+		return err
+	}
+	file, err := os.Open(strings.TrimSuffix(p.idxFile, ".idx") + ".pack")
+	if err != nil {
+		_ = idx.Close()
+		return err
+	}
+	p.idx = idx
+	p.file = file
+	return nil
+}
+
+// readHeader reads the fanout table of the index and finds the tables after
+// it.
+func (p *pack) readHeader(idx *os.File) error {
+	var b [8 + 256*4]byte
+	n, err := idx.ReadAt(b[:], 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n < len(b) || !bytes.Equal(b[:4], []byte{0xff, 't', 'O', 'c'}) {
+		// Version 1 indexes have not been written by git since 2008.
+		return errUnsupported
+	}
+	if binary.BigEndian.Uint32(b[4:8]) != 2 {
+		return errUnsupported
+	}
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(b[8+i*4:])
+	}
+	fi, err := idx.Stat()
+	if err != nil {
+		return err
+	}
+	p.size = fi.Size()
+	count := int64(p.fanout[255])
+	p.shas = int64(len(b))
+	// Skip CRC32 checksums.
+	p.offsets = p.shas + count*(20+4)
+	p.large = p.offsets + count*4
+	if p.size < p.large {
+		return fmt.Errorf("pack index %s corrupt", p.idxFile)
+	}
+	return nil
+}
+
+func (p *pack) close() {
+	if p.idx != nil {
+		_ = p.idx.Close()
+	}
+	if p.file != nil {
+		_ = p.file.Close()
+	}
+}
+
+// readIndex reads len(b) bytes at the offset in the index.
+func (p *pack) readIndex(b []byte, off int64) error {
+	if off+int64(len(b)) > p.size {
+		return fmt.Errorf("pack index %s corrupt", p.idxFile)
+	}
+	_, err := p.idx.ReadAt(b, off)
+	return err
+}
+
+// find returns the offset of an object in the pack.
+func (p *pack) find(sha [20]byte) (int64, bool, error) {
+	if err := p.open(); err != nil {
+		return 0, false, err
+	}
+	lo := 0
+	if sha[0] > 0 {
+		lo = int(p.fanout[sha[0]-1])
+	}
+	hi := int(p.fanout[sha[0]])
+	var b [20]byte
+	var err error
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		err = p.readIndex(b[:], p.shas+int64(lo+i)*20)
+		return bytes.Compare(b[:], sha[:]) >= 0
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if i >= hi {
+		return 0, false, nil
+	}
+	if err := p.readIndex(b[:], p.shas+int64(i)*20); err != nil {
+		return 0, false, err
+	}
+	if b != sha {
+		return 0, false, nil
+	}
+	if err := p.readIndex(b[:4], p.offsets+int64(i)*4); err != nil {
+		return 0, false, err
+	}
+	off := binary.BigEndian.Uint32(b[:4])
+	if off&0x80000000 == 0 {
+		return int64(off), true, nil
+	}
+	// Offsets over 2GB are stored in a separate table.
+	if err := p.readIndex(b[:8], p.large+int64(off&0x7fffffff)*8); err != nil {
+		return 0, false, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:8])), true, nil
+}
+
+// read reads the object at the offset, resolving deltas. Deltas against
+// objects outside the pack are read from the store. depth is the number of
+// deltas the object is the base of.
+func (p *pack) read(off int64, s *objectStore, depth int) (int, []byte, error) {
+	if o, ok := p.bases[off]; ok {
+		return o.typ, o.data, nil
+	}
+	if depth > maxDeltaDepth {
+		return 0, nil, fmt.Errorf("pack object at %d corrupt: delta chain too long", off)
+	}
+
+	var header [32]byte
+	n, err := p.file.ReadAt(header[:], off)
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	h := header[:n]
+	if len(h) == 0 {
+		return 0, nil, fmt.Errorf("pack object at %d corrupt", off)
+	}
+	typ := int(h[0]>>4) & 7
+	size := int64(h[0] & 0x0f)
+	shift := uint(4)
+	i := 1
+	for h[i-1]&0x80 != 0 {
+		if i >= len(h) {
+			return 0, nil, fmt.Errorf("pack object at %d corrupt", off)
+		}
+		size |= int64(h[i]&0x7f) << shift
+		shift += 7
+		i++
+		if size > maxObjectSize {
+			return 0, nil, errUnsupported
+		}
+	}
+
+	var base []byte
+	baseType := 0
+	switch typ {
+	case objOfsDelta:
+		rel, n := readOffset(h[i:])
+		if n == 0 || rel <= 0 || int64(rel) > off {
+			return 0, nil, fmt.Errorf("pack object at %d corrupt", off)
+		}
+		i += n
+		baseType, base, err = p.read(off-int64(rel), s, depth+1)
+	case objRefDelta:
+		if i+20 > len(h) {
+			return 0, nil, fmt.Errorf("pack object at %d corrupt", off)
+		}
+		var sha [20]byte
+		copy(sha[:], h[i:i+20])
+		i += 20
+		baseType, base, err = s.readDelta(sha, depth+1)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	zr, err := zlib.NewReader(io.NewSectionReader(p.file, off+int64(i), 1<<62))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return 0, nil, err
+	}
+
+	if base != nil {
+		data, err = applyDelta(base, data)
+		if err != nil {
+			return 0, nil, err
+		}
+		typ = baseType
+	}
+	p.cache(off, packObject{typ: typ, data: data})
+	return typ, data, nil
+}
+
+// cache caches the object read at the offset, emptying the cache first if it
+// would grow too large.
+func (p *pack) cache(off int64, o packObject) {
+	if p.cached+len(o.data) > maxCachedBases {
+		p.bases = make(map[int64]packObject)
+		p.cached = 0
+	}
+	if len(o.data) > maxCachedBases {
+		return
+	}
+	p.bases[off] = o
+	p.cached += len(o.data)
+}
+
+var errDeltaCorrupt = errors.New("delta corrupt")
+
+func applyDelta(base, delta []byte) ([]byte, error) {
+	readSize := func() int {
+		v := 0
+		shift := uint(0)
+		for len(delta) > 0 {
+			c := delta[0]
+			delta = delta[1:]
+			v |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		return v
+	}
+	if readSize() != len(base) {
+		return nil, errDeltaCorrupt
+	}
+	size := readSize()
+	if size < 0 || size > maxObjectSize {
+		return nil, errUnsupported
+	}
+	out := make([]byte, 0, size)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			// Copy from base.
+			var off, size int
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errDeltaCorrupt
+				}
+				if i < 4 {
+					off |= int(delta[0]) << (8 * i)
+				} else {
+					size |= int(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > len(base) || len(out)+size > cap(out) {
+				return nil, errDeltaCorrupt
+			}
+			out = append(out, base[off:off+size]...)
+		case op != 0:
+			// Insert new data.
+			n := int(op)
+			if n > len(delta) || len(out)+n > cap(out) {
+				return nil, errDeltaCorrupt
+			}
+			out = append(out, delta[:n]...)
+			delta = delta[n:]
+		default:
+			return nil, errDeltaCorrupt
+		}
+	}
+	if len(out) != cap(out) {
+		return nil, errDeltaCorrupt
+	}
+	return out, nil
+}
+
+// hashBlob returns the sha git would give the contents as a blob.
+func hashBlob(r io.Reader, size int64) ([20]byte, error) {
+	var sha [20]byte
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", size)
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return sha, err
+	}
+	if n != size {
+		return sha, io.ErrUnexpectedEOF
+	}
+	copy(sha[:], h.Sum(nil))
+	return sha, nil
+}
@@ -0,0 +1,83 @@
+package gitprompt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Operation is a multi-step git operation that can stop to let the user
+// resolve conflicts.
+type Operation string
+
+// Operations that can be in progress.
+const (
+	NoOperation Operation = ""
+	Rebase      Operation = "rebase"
+	Am          Operation = "am"
+	Merge       Operation = "merge"
+	CherryPick  Operation = "cherry-pick"
+	Revert      Operation = "revert"
+	Bisect      Operation = "bisect"
+)
+
+// readOperation sets the operation in progress in the repository dir is part
+// of. The status is not changed if dir is not part of a repository.
+func readOperation(dir string, s *GitStatus) error {
+	if dir == "" {
+		dir = "."
+	}
+	repo, err := findRepository(dir)
+	if repo == nil || err != nil {
+		return err
+	}
+	s.Operation, s.Step, s.Steps = repo.operation()
+	return nil
+}
+
+// operation returns the operation in progress and, for rebases and am, the
+// current step and the number of steps.
+func (r *repository) operation() (Operation, int, int) {
+	if r.exists("rebase-merge") {
+		step := r.readInt("rebase-merge", "msgnum")
+		steps := r.readInt("rebase-merge", "end")
+		return Rebase, step, steps
+	}
+	if r.exists("rebase-apply") {
+		step := r.readInt("rebase-apply", "next")
+		steps := r.readInt("rebase-apply", "last")
+		if r.exists("rebase-apply", "applying") {
+			return Am, step, steps
+		}
+		return Rebase, step, steps
+	}
+	switch {
+	case r.exists("MERGE_HEAD"):
+		return Merge, 0, 0
+	case r.exists("CHERRY_PICK_HEAD"):
+		return CherryPick, 0, 0
+	case r.exists("REVERT_HEAD"):
+		return Revert, 0, 0
+	case r.exists("BISECT_LOG"):
+		return Bisect, 0, 0
+	}
+	return NoOperation, 0, 0
+}
+
+func (r *repository) exists(name ...string) bool {
+	_, err := os.Stat(filepath.Join(r.gitDir, filepath.Join(name...)))
+	return err == nil
+}
+
+// readInt reads a file in the git dir containing a number. Returns 0 if the
+// file can't be read.
+func (r *repository) readInt(name ...string) int {
+	b, err := ioutil.ReadFile(filepath.Join(r.gitDir, filepath.Join(name...)))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
@@ -1,32 +1,137 @@
 package gitprompt
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 )
 
-// GitStatus is the parsed status for the current state in git.
+// GitStatus is the parsed status for the current state in git. The names in
+// the JSON tags are stable and are what gitprompt -json prints.
 type GitStatus struct {
-	Sha       string
-	Branch    string
-	Untracked int
-	Modified  int
-	Staged    int
-	Conflicts int
-	Ahead     int
-	Behind    int
+	Sha       string `json:"sha"`
+	Branch    string `json:"branch"`
+	Untracked int    `json:"untracked"`
+	Modified  int    `json:"modified"`
+	Staged    int    `json:"staged"`
+	Conflicts int    `json:"conflicts"`
+
+	// Index and Worktree count the staged and modified files by the kind of
+	// change. Staged and Modified are their totals.
+	Index    Changes `json:"index"`
+	Worktree Changes `json:"worktree"`
+
+	// Changed is the number of files that are staged, modified, untracked
+	// or in conflict. A file that is both staged and modified is counted
+	// once.
+	Changed int `json:"changed"`
+
+	Ahead   int `json:"ahead"`
+	Behind  int `json:"behind"`
+	Stashes int `json:"stashes"`
+
+	// Upstream is the branch being tracked, such as origin/master. It's
+	// empty if no upstream is configured.
+	Upstream string `json:"upstream"`
+	// UpstreamGone is set if the upstream is configured but the branch no
+	// longer exists, usually because it was deleted from the remote.
+	UpstreamGone bool `json:"upstream_gone"`
+
+	// Operation is the operation in progress, such as a rebase or merge.
+	Operation Operation `json:"operation"`
+	// Step and Steps are the progress of a rebase or am, such as 3 of 7.
+	Step  int `json:"step"`
+	Steps int `json:"steps"`
+
+	// TimedOut is set if getting the status took too long and only the
+	// branch and sha are known.
+	TimedOut bool `json:"timed_out"`
+
+	// Files lists the changed and untracked files. It's only set if
+	// requested from the source, such as with ExecSource.Files.
+	Files []FileStatus `json:"files,omitempty"`
+}
+
+// Clean returns true if nothing is staged, modified, untracked or in
+// conflict. It returns false if the status timed out, as it's not known.
+func (s *GitStatus) Clean() bool {
+	return !s.TimedOut && s.Staged+s.Modified+s.Untracked+s.Conflicts == 0
+}
+
+// Dirty returns true if anything is staged, modified, untracked or in
+// conflict.
+func (s *GitStatus) Dirty() bool {
+	return s.Staged+s.Modified+s.Untracked+s.Conflicts > 0
+}
+
+// Changes counts changed files by the kind of change.
+type Changes struct {
+	Modified int `json:"modified"`
+	Added    int `json:"added"`
+	Deleted  int `json:"deleted"`
+	Renamed  int `json:"renamed"`
+	// Copied is only counted if status.renames is set to copies, as git
+	// status doesn't detect copies otherwise. The native reader never
+	// detects copies, so NativeSource runs git status in that case.
+	Copied      int `json:"copied"`
+	TypeChanged int `json:"type_changed"`
+}
+
+// count counts a change to a file in the state.
+func (c *Changes) count(state FileState) {
+	switch state {
+	case StateModified:
+		c.Modified++
+	case StateAdded:
+		c.Added++
+	case StateDeleted:
+		c.Deleted++
+	case StateRenamed:
+		c.Renamed++
+	case StateCopied:
+		c.Copied++
+	case StateTypeChanged:
+		c.TypeChanged++
+	}
 }
 
 // Parse parses the status for the repository from git. Returns nil if the
 // current directory is not part of a git repository.
 func Parse() (*GitStatus, error) {
-	status := &GitStatus{}
+	return ParseWith(ExecSource{})
+}
+
+// ParseDir parses the status for the repository dir is part of. Returns nil
+// if dir is not part of a git repository.
+func ParseDir(dir string) (*GitStatus, error) {
+	return ParseWith(ExecSource{Dir: dir})
+}
+
+// ExecSource gets the status by running git status and parsing its porcelain
+// v2 output. It is the source used by Parse.
+type ExecSource struct {
+	// Dir is the directory to get the status for. Defaults to the current
+	// directory.
+	Dir string
+	// Files requests the list of changed files in GitStatus.Files.
+	Files bool
+	// Untracked is how untracked files are found. By default git status
+	// decides, using the status.showUntrackedFiles config.
+	Untracked UntrackedMode
+}
 
-	stat, err := runGitCommand("git", "status", "--branch", "--porcelain=2")
+// Status implements StatusSource.
+func (src ExecSource) Status(ctx context.Context) (*GitStatus, error) {
+	args := []string{"status", "--branch", "--show-stash", "--porcelain=2", "-z"}
+	if src.Untracked != UntrackedNormal {
+		args = append(args, "--untracked-files="+string(src.Untracked))
+	}
+	stat, err := runGitCommand(ctx, src.Dir, "git", args...)
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "fatal:") {
 			return nil, nil
@@ -34,59 +139,281 @@ func Parse() (*GitStatus, error) {
 		return nil, err
 	}
 
-	lines := strings.Split(stat, "\n")
-	for _, line := range lines {
-		switch line[0] {
+	status, err := parseStatus(stat, src.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := readOperation(src.Dir, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// ParseError is returned if the output of git status can't be parsed.
+type ParseError struct {
+	// Record is the offending record, without the NUL terminator.
+	Record string
+	// Reason describes what was wrong with the record.
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse git status: %s: %q", e.Reason, e.Record)
+}
+
+// parseStatus parses the output of git status --porcelain=2 -z. The files are
+// only listed if files is set.
+func parseStatus(out string, files bool) (*GitStatus, error) {
+	status := &GitStatus{}
+	r := &recordReader{data: out}
+	for {
+		record, ok := r.next()
+		if !ok {
+			break
+		}
+		if record == "" {
+			return nil, &ParseError{Record: record, Reason: "empty record"}
+		}
+		var file *FileStatus
+		var err error
+		switch record[0] {
 		case '#':
-			parseHeader(line, status)
-		case '?':
-			status.Untracked++
+			err = parseHeader(record, status)
+		case '?', '!':
+			file, err = parseUntracked(record)
+			if file != nil && file.Index == StateUntracked {
+				status.Untracked++
+			}
 		case 'u':
-			status.Conflicts++
-		case '1', '2':
-			parts := strings.Split(line, " ")
-			if parts[1][0] != '.' {
-				status.Staged++
+			file, err = parseUnmerged(record)
+			if file != nil {
+				status.Conflicts++
 			}
-			if parts[1][1] != '.' {
-				status.Modified++
+		case '1', '2':
+			file, err = parseChanged(record, r)
+			if file != nil {
+				if file.Index != StateUnmodified {
+					status.Staged++
+					status.Index.count(file.Index)
+				}
+				if file.Worktree != StateUnmodified {
+					status.Modified++
+					status.Worktree.count(file.Worktree)
+				}
 			}
+		default:
+			err = &ParseError{Record: record, Reason: "unknown record type"}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if file != nil && file.Index != StateIgnored {
+			status.Changed++
+		}
+		if file != nil && files {
+			status.Files = append(status.Files, *file)
 		}
 	}
-
 	return status, nil
 }
 
-func parseHeader(h string, s *GitStatus) {
-	if strings.HasPrefix(h, "# branch.oid") {
+// recordReader splits the output of git status -z into NUL terminated
+// records. Paths can contain any character except NUL, including spaces and
+// newlines.
+type recordReader struct {
+	data string
+	pos  int
+}
+
+// next returns the next record, or false if there are no more records. The
+// terminator of the last record is optional.
+func (r *recordReader) next() (string, bool) {
+	if r.pos >= len(r.data) {
+		return "", false
+	}
+	rest := r.data[r.pos:]
+	i := strings.IndexByte(rest, 0)
+	if i < 0 {
+		r.pos = len(r.data)
+		return rest, true
+	}
+	r.pos += i + 1
+	return rest[:i], true
+}
+
+// fields splits the record into n space separated fields, the last of which
+// is the rest of the record, such as a path that may contain spaces.
+func fields(record string, n int) ([]string, error) {
+	parts := strings.SplitN(record, " ", n)
+	if len(parts) != n {
+		return nil, &ParseError{Record: record, Reason: fmt.Sprintf("expected %d fields, got %d", n, len(parts))}
+	}
+	if parts[n-1] == "" {
+		return nil, &ParseError{Record: record, Reason: "missing path"}
+	}
+	return parts, nil
+}
+
+// parseUntracked parses an untracked or ignored entry:
+//
+//	? <path>
+//	! <path>
+func parseUntracked(record string) (*FileStatus, error) {
+	parts, err := fields(record, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts[0]) != 1 {
+		return nil, &ParseError{Record: record, Reason: "unknown record type"}
+	}
+	state := FileState(parts[0][0])
+	return &FileStatus{Path: parts[1], Index: state, Worktree: state}, nil
+}
+
+// parseUnmerged parses an unmerged entry:
+//
+//	u <XY> <sub> <m1> <m2> <m3> <mW> <h1> <h2> <h3> <path>
+func parseUnmerged(record string) (*FileStatus, error) {
+	parts, err := fields(record, 11)
+	if err != nil {
+		return nil, err
+	}
+	conflict, ok := conflictCodes[parts[1]]
+	if !ok {
+		return nil, &ParseError{Record: record, Reason: "invalid conflict code"}
+	}
+	submodule, err := parseSubmodule(record, parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return &FileStatus{
+		Path:      parts[10],
+		Index:     StateUnmerged,
+		Worktree:  StateUnmerged,
+		Submodule: submodule,
+		Conflict:  conflict,
+	}, nil
+}
+
+// parseChanged parses an ordinary or renamed/copied entry. The original path
+// of a rename is read from the next record.
+//
+//	1 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <path>
+//	2 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <X><score> <path>
+func parseChanged(record string, r *recordReader) (*FileStatus, error) {
+	n := 9
+	if record[0] == '2' {
+		n = 10
+	}
+	parts, err := fields(record, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts[0]) != 1 {
+		return nil, &ParseError{Record: record, Reason: "unknown record type"}
+	}
+	if len(parts[1]) != 2 || !validState(parts[1][0]) || !validState(parts[1][1]) {
+		return nil, &ParseError{Record: record, Reason: "invalid XY state"}
+	}
+	submodule, err := parseSubmodule(record, parts[2])
+	if err != nil {
+		return nil, err
+	}
+	file := &FileStatus{
+		Path:      parts[n-1],
+		Index:     FileState(parts[1][0]),
+		Worktree:  FileState(parts[1][1]),
+		Submodule: submodule,
+	}
+	if record[0] == '2' {
+		if score := parts[8]; score == "" || score[0] != 'R' && score[0] != 'C' {
+			return nil, &ParseError{Record: record, Reason: "invalid rename score"}
+		}
+		orig, ok := r.next()
+		if !ok || orig == "" {
+			return nil, &ParseError{Record: record, Reason: "missing original path"}
+		}
+		file.OrigPath = orig
+	}
+	return file, nil
+}
+
+// parseSubmodule parses the submodule state, N... for files and S<c><m><u>
+// for submodules.
+func parseSubmodule(record, sub string) (bool, error) {
+	if len(sub) != 4 || sub[0] != 'N' && sub[0] != 'S' {
+		return false, &ParseError{Record: record, Reason: "invalid submodule state"}
+	}
+	return sub[0] == 'S', nil
+}
+
+// validState returns true if c is a state git status uses for the X or Y of
+// a changed entry.
+func validState(c byte) bool {
+	switch FileState(c) {
+	case StateUnmodified, StateModified, StateTypeChanged, StateAdded,
+		StateDeleted, StateRenamed, StateCopied, StateUnmerged:
+		return true
+	}
+	return false
+}
+
+// parseHeader parses a header record. Unknown headers are ignored so newer
+// versions of git can add them.
+func parseHeader(h string, s *GitStatus) error {
+	switch {
+	case strings.HasPrefix(h, "# branch.oid "):
 		hash := h[13:]
 		if hash != "(initial)" {
 			s.Sha = hash
 		}
-		return
-	}
-	if strings.HasPrefix(h, "# branch.head") {
+	case strings.HasPrefix(h, "# branch.head "):
 		branch := h[14:]
 		if branch != "(detached)" {
 			s.Branch = branch
 		}
-		return
-	}
-	if strings.HasPrefix(h, "# branch.ab") {
+	case strings.HasPrefix(h, "# branch.upstream "):
+		s.Upstream = h[18:]
+		// Ahead and behind follow the upstream, but only if it exists.
+		s.UpstreamGone = true
+	case strings.HasPrefix(h, "# branch.ab "):
 		parts := strings.Split(h, " ")
-		s.Ahead, _ = strconv.Atoi(strings.TrimPrefix(parts[2], "+"))
-		s.Behind, _ = strconv.Atoi(strings.TrimPrefix(parts[3], "-"))
-		return
+		if len(parts) != 4 || !strings.HasPrefix(parts[2], "+") || !strings.HasPrefix(parts[3], "-") {
+			return &ParseError{Record: h, Reason: "invalid ahead/behind"}
+		}
+		ahead, err1 := strconv.Atoi(parts[2][1:])
+		behind, err2 := strconv.Atoi(parts[3][1:])
+		if err1 != nil || err2 != nil {
+			return &ParseError{Record: h, Reason: "invalid ahead/behind"}
+		}
+		s.UpstreamGone = false
+		s.Ahead, s.Behind = ahead, behind
+	case strings.HasPrefix(h, "# stash "):
+		n, err := strconv.Atoi(h[8:])
+		if err != nil {
+			return &ParseError{Record: h, Reason: "invalid stash count"}
+		}
+		s.Stashes = n
 	}
+	return nil
 }
 
-func runGitCommand(cmd string, args ...string) (string, error) {
+func runGitCommand(ctx context.Context, dir, cmd string, args ...string) (string, error) {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	command := exec.Command(cmd, args...)
-	command.Stdout = bufio.NewWriter(&stdout)
-	command.Stderr = bufio.NewWriter(&stderr)
+	command := exec.CommandContext(ctx, cmd, args...)
+	command.Dir = dir
+	// git status may take a lock to refresh the index, which would be left
+	// behind if the command is killed when the context is done.
+	command.Env = append(os.Environ(), "GIT_OPTIONAL_LOCKS=0")
+	command.Stdout = &stdout
+	command.Stderr = &stderr
 	if err := command.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		if stderr.Len() > 0 {
 			return "", errors.New(stderr.String())
 		}
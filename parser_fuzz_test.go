@@ -0,0 +1,51 @@
+//go:build go1.18
+// +build go1.18
+
+package gitprompt
+
+import "testing"
+
+func FuzzParseStatus(f *testing.F) {
+	seeds := []string{
+		"# branch.oid (initial)\x00# branch.head master\x00",
+		"# branch.oid 4a1e9b2c\x00# branch.head (detached)\x00",
+		"# branch.upstream origin/master\x00# branch.ab +1 -2\x00# stash 3\x00",
+		"1 .M N... 100644 100644 100644 aaa aaa file\x00",
+		"1 A. N... 000000 100644 100644 000 bbb with space\x00",
+		"1 .M SC.. 160000 160000 160000 aaa aaa submodule\x00",
+		"2 R. N... 100644 100644 100644 aaa aaa R100 new\nline\x00old\x00",
+		"2 C. N... 100644 100644 100644 aaa aaa C75 copy\x00orig\x00",
+		"u UU N... 100644 100644 100644 100644 aaa bbb ccc conflict\x00",
+		"u DD N... 100644 000000 000000 000000 aaa 000 000 gone\x00",
+		"? untracked\x00? dir/\x00",
+		"! ignored\x00",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, out string) {
+		s, err := parseStatus(out, true)
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("Expected *ParseError, got %T: %v", err, err)
+			}
+			if s != nil {
+				t.Fatalf("Expected nil status with error, got %+v", s)
+			}
+			return
+		}
+		n := 0
+		for _, file := range s.Files {
+			if file.Path == "" {
+				t.Errorf("Empty path in %+v", file)
+			}
+			if file.Index != StateIgnored {
+				n++
+			}
+		}
+		if total := s.Untracked + s.Conflicts; total > n {
+			t.Errorf("Counted %d untracked and conflicts but only %d files", total, n)
+		}
+	})
+}
@@ -3,12 +3,17 @@ package gitprompt
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParseValues(t *testing.T) {
@@ -98,7 +103,8 @@ func TestParseValues(t *testing.T) {
 				git commit --allow-empty -m 'second'
 			`,
 			expected: &GitStatus{
-				Ahead: 1,
+				Ahead:    1,
+				Upstream: "origin/master",
 			},
 		},
 		{
@@ -112,7 +118,37 @@ func TestParseValues(t *testing.T) {
 				git reset --hard HEAD^
 			`,
 			expected: &GitStatus{
-				Behind: 1,
+				Behind:   1,
+				Upstream: "origin/master",
+			},
+		},
+		{
+			name: "upstream gone",
+			setup: `
+				git init
+				git remote add origin $REMOTE
+				git commit --allow-empty -m 'first'
+				git push -u origin HEAD
+				git branch -r -d origin/master
+			`,
+			expected: &GitStatus{
+				Upstream:     "origin/master",
+				UpstreamGone: true,
+			},
+		},
+		{
+			name: "stashes",
+			setup: `
+				git init
+				git commit --allow-empty -m 'initial'
+				touch test
+				git add test
+				git stash
+				touch other
+				git stash push -u -- other
+			`,
+			expected: &GitStatus{
+				Stashes: 2,
 			},
 		},
 	}
@@ -146,6 +182,9 @@ func TestParseValues(t *testing.T) {
 			assertInt(t, "Conflicts", test.expected.Conflicts, actual.Conflicts)
 			assertInt(t, "Ahead", test.expected.Ahead, actual.Ahead)
 			assertInt(t, "Behind", test.expected.Behind, actual.Behind)
+			assertInt(t, "Stashes", test.expected.Stashes, actual.Stashes)
+			assertString(t, "Upstream", test.expected.Upstream, actual.Upstream)
+			assertBool(t, "UpstreamGone", test.expected.UpstreamGone, actual.UpstreamGone)
 		})
 	}
 }
@@ -183,6 +222,431 @@ func TestParseHead(t *testing.T) {
 	}
 }
 
+func TestParseDir(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		mkdir sub
+		touch sub/test
+		git add sub/test
+	`)
+	if err := os.Chdir(os.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ParseDir(path.Join(dir, "sub"))
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	assertString(t, "branch", "master", s.Branch)
+	assertInt(t, "Staged", 1, s.Staged)
+
+	s, err = ParseDir(os.TempDir())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if s != nil {
+		t.Errorf("Expected nil return outside repository, got %v", s)
+	}
+}
+
+func TestParseChanges(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		for f in modified deleted renamed typechanged wmodified wdeleted wtypechanged; do
+			echo $f > $f
+		done
+		git add modified deleted renamed typechanged wmodified wdeleted wtypechanged
+		git commit -m 'initial'
+
+		echo changed > modified
+		git rm deleted
+		git mv renamed renamed2
+		rm typechanged
+		ln -s modified typechanged
+		touch added
+		git add modified typechanged added
+
+		echo changed > wmodified
+		rm wdeleted
+		rm wtypechanged
+		ln -s wmodified wtypechanged
+		touch ita
+		git add -N ita
+	`)
+
+	for _, src := range []StatusSource{ExecSource{}, NativeSource{}} {
+		s, err := ParseWith(src)
+		if err != nil {
+			t.Fatalf("%T: Received unexpected error: %v", src, err)
+		}
+		expectedIndex := Changes{Modified: 1, Added: 1, Deleted: 1, Renamed: 1, TypeChanged: 1}
+		if s.Index != expectedIndex {
+			t.Errorf("%T: Index does not match\n\tExpected: %+v\n\tActual:   %+v", src, expectedIndex, s.Index)
+		}
+		expectedWorktree := Changes{Modified: 1, Added: 1, Deleted: 1, TypeChanged: 1}
+		if s.Worktree != expectedWorktree {
+			t.Errorf("%T: Worktree does not match\n\tExpected: %+v\n\tActual:   %+v", src, expectedWorktree, s.Worktree)
+		}
+		assertInt(t, "Staged", 5, s.Staged)
+		assertInt(t, "Modified", 4, s.Modified)
+		assertInt(t, "Changed", 9, s.Changed)
+	}
+}
+
+func TestParseFiles(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		echo base > conflict
+		echo a > "with space"
+		echo b > renamed
+		git add conflict "with space" renamed
+		git commit -m 'initial'
+		git checkout -b other
+		echo other > conflict
+		git commit -am 'other'
+		git checkout master
+		echo master > conflict
+		git commit -am 'master'
+		git merge other || true
+
+		echo changed > "with space"
+		git add "with space"
+		echo again > "with space"
+		git mv renamed "new
+line"
+		mkdir untracked
+		touch untracked/file
+	`)
+
+	expected := []FileStatus{
+		{Path: "new\nline", OrigPath: "renamed", Index: StateRenamed, Worktree: StateUnmodified},
+		{Path: "with space", Index: StateModified, Worktree: StateModified},
+		{Path: "conflict", Index: StateUnmerged, Worktree: StateUnmerged, Conflict: BothModified},
+		{Path: "untracked/", Index: StateUntracked, Worktree: StateUntracked},
+	}
+	for _, src := range []StatusSource{ExecSource{Files: true}, NativeSource{Files: true}} {
+		s, err := ParseWith(src)
+		if err != nil {
+			t.Fatalf("%T: Received unexpected error: %v", src, err)
+		}
+		if !reflect.DeepEqual(s.Files, expected) {
+			t.Errorf("%T: Files does not match\n\tExpected: %+v\n\tActual:   %+v", src, expected, s.Files)
+		}
+		assertInt(t, "Changed", 4, s.Changed)
+	}
+
+	s, err := ParseWith(ExecSource{})
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if s.Files != nil {
+		t.Errorf("Expected no files unless requested, got %+v", s.Files)
+	}
+}
+
+func TestParseUntrackedMode(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		touch tracked
+		git add tracked
+		git commit -m 'initial'
+		touch top
+		mkdir -p dir/sub
+		touch dir/a dir/sub/b
+		mkdir nested
+		git -C nested init
+	`)
+
+	tests := []struct {
+		mode      UntrackedMode
+		untracked int
+		files     []string
+	}{
+		{UntrackedNormal, 3, []string{"dir/", "nested/", "top"}},
+		{UntrackedNo, 0, nil},
+		{UntrackedAll, 4, []string{"dir/a", "dir/sub/b", "nested/", "top"}},
+	}
+	for _, test := range tests {
+		sources := []StatusSource{
+			ExecSource{Files: true, Untracked: test.mode},
+			NativeSource{Files: true, Untracked: test.mode},
+		}
+		for _, src := range sources {
+			s, err := ParseWith(src)
+			if err != nil {
+				t.Fatalf("%T %s: Received unexpected error: %v", src, test.mode.String(), err)
+			}
+			var files []string
+			for _, f := range s.Files {
+				files = append(files, f.Path)
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("%T %s: Expected files %q, got %q", src, test.mode.String(), test.files, files)
+			}
+			assertInt(t, "Untracked", test.untracked, s.Untracked)
+			assertInt(t, "Changed", test.untracked, s.Changed)
+		}
+	}
+}
+
+func TestUntrackedModeSet(t *testing.T) {
+	var m UntrackedMode
+	for _, name := range []string{"no", "all", "normal", ""} {
+		if err := m.Set(name); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+	assertString(t, "mode", "normal", m.String())
+	if err := m.Set("some"); err == nil {
+		t.Errorf("Expected error for unknown mode")
+	}
+}
+
+func TestCleanDirty(t *testing.T) {
+	tests := []struct {
+		name   string
+		status *GitStatus
+		clean  bool
+		dirty  bool
+	}{
+		{"clean", &GitStatus{Ahead: 1, Stashes: 2}, true, false},
+		{"staged", &GitStatus{Staged: 1}, false, true},
+		{"modified", &GitStatus{Modified: 1}, false, true},
+		{"untracked", &GitStatus{Untracked: 1}, false, true},
+		{"conflicts", &GitStatus{Conflicts: 1}, false, true},
+		{"timed out", &GitStatus{TimedOut: true}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertBool(t, "Clean", test.clean, test.status.Clean())
+			assertBool(t, "Dirty", test.dirty, test.status.Dirty())
+		})
+	}
+}
+
+func TestParseOperation(t *testing.T) {
+	conflict := `
+		git init
+		git commit --allow-empty -m 'initial'
+		git checkout -b other
+		echo bar >> test
+		git add test
+		git commit -m 'other'
+		git checkout master
+		echo foo >> test
+		git add test
+		git commit -m 'master'
+	`
+	tests := []struct {
+		name      string
+		setup     string
+		operation Operation
+		step      int
+		steps     int
+	}{
+		{
+			name: "none",
+			setup: `
+				git init
+				git commit --allow-empty -m 'initial'
+			`,
+			operation: NoOperation,
+		},
+		{
+			name:      "rebase",
+			setup:     conflict + "git rebase other || true",
+			operation: Rebase,
+			step:      1,
+			steps:     1,
+		},
+		{
+			name: "rebase steps",
+			setup: `
+				git init
+				for i in 1 2 3; do git commit --allow-empty -m "$i"; done
+				git rebase --exec false HEAD~2 || true
+			`,
+			operation: Rebase,
+			step:      2,
+			steps:     4,
+		},
+		{
+			name:      "am",
+			setup:     conflict + "git format-patch -1 other --stdout > .git/test.patch\ngit am .git/test.patch || true",
+			operation: Am,
+			step:      1,
+			steps:     1,
+		},
+		{
+			name:      "merge",
+			setup:     conflict + "git merge other || true",
+			operation: Merge,
+		},
+		{
+			name:      "cherry-pick",
+			setup:     conflict + "git cherry-pick other || true",
+			operation: CherryPick,
+		},
+		{
+			name:      "revert",
+			setup:     conflict + "echo baz >> test\ngit commit -am 'baz'\ngit revert --no-edit HEAD~1 || true",
+			operation: Revert,
+		},
+		{
+			name: "bisect",
+			setup: `
+				git init
+				git commit --allow-empty -m 'initial'
+				git bisect start
+			`,
+			operation: Bisect,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, done := setupTestDir(t)
+			defer done()
+			setupCommands(t, dir, test.setup)
+
+			for _, src := range []StatusSource{ExecSource{}, NativeSource{}} {
+				s, err := ParseWith(src)
+				if err != nil {
+					t.Fatalf("%T: Received unexpected error: %v", src, err)
+				}
+				assertString(t, fmt.Sprintf("%T Operation", src), string(test.operation), string(s.Operation))
+				assertInt(t, fmt.Sprintf("%T Step", src), test.step, s.Step)
+				assertInt(t, fmt.Sprintf("%T Steps", src), test.steps, s.Steps)
+			}
+		})
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	out := "# branch.oid 4a1e9b2c\x00" +
+		"# branch.head master\x00" +
+		"# branch.upstream origin/master\x00" +
+		"# branch.ab +1 -2\x00" +
+		"# stash 3\x00" +
+		"# branch.future unknown header\x00" +
+		"1 M. N... 100644 100644 100644 aaa bbb with space\x00" +
+		"2 R. N... 100644 100644 100644 aaa aaa R100 new\nline\x00old\x00" +
+		"u UU N... 100644 100644 100644 100644 aaa bbb ccc conflict\x00" +
+		"? untracked\x00" +
+		"! ignored\x00"
+
+	s, err := parseStatus(out, true)
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	assertString(t, "Sha", "4a1e9b2c", s.Sha)
+	assertString(t, "Branch", "master", s.Branch)
+	assertString(t, "Upstream", "origin/master", s.Upstream)
+	assertInt(t, "Ahead", 1, s.Ahead)
+	assertInt(t, "Behind", 2, s.Behind)
+	assertInt(t, "Stashes", 3, s.Stashes)
+	assertInt(t, "Staged", 2, s.Staged)
+	assertInt(t, "Modified", 0, s.Modified)
+	assertInt(t, "Conflicts", 1, s.Conflicts)
+	assertInt(t, "Untracked", 1, s.Untracked)
+
+	expected := []FileStatus{
+		{Path: "with space", Index: StateModified, Worktree: StateUnmodified},
+		{Path: "new\nline", OrigPath: "old", Index: StateRenamed, Worktree: StateUnmodified},
+		{Path: "conflict", Index: StateUnmerged, Worktree: StateUnmerged, Conflict: BothModified},
+		{Path: "untracked", Index: StateUntracked, Worktree: StateUntracked},
+		{Path: "ignored", Index: StateIgnored, Worktree: StateIgnored},
+	}
+	if !reflect.DeepEqual(s.Files, expected) {
+		t.Errorf("Files does not match\n\tExpected: %+v\n\tActual:   %+v", expected, s.Files)
+	}
+}
+
+func TestParseStatusErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		out    string
+		record string
+	}{
+		{
+			name:   "empty record",
+			out:    "# branch.head master\x00\x00",
+			record: "",
+		},
+		{
+			name:   "unknown type",
+			out:    "x foo\x00",
+			record: "x foo",
+		},
+		{
+			name:   "truncated ordinary",
+			out:    "1 M.\x00",
+			record: "1 M.",
+		},
+		{
+			name:   "missing path",
+			out:    "? \x00",
+			record: "? ",
+		},
+		{
+			name:   "invalid state",
+			out:    "1 Z. N... 100644 100644 100644 aaa bbb file\x00",
+			record: "1 Z. N... 100644 100644 100644 aaa bbb file",
+		},
+		{
+			name:   "invalid submodule",
+			out:    "1 M. X 100644 100644 100644 aaa bbb file\x00",
+			record: "1 M. X 100644 100644 100644 aaa bbb file",
+		},
+		{
+			name:   "missing original path",
+			out:    "2 R. N... 100644 100644 100644 aaa aaa R100 new\x00",
+			record: "2 R. N... 100644 100644 100644 aaa aaa R100 new",
+		},
+		{
+			name:   "invalid conflict",
+			out:    "u MM N... 100644 100644 100644 100644 aaa bbb ccc file\x00",
+			record: "u MM N... 100644 100644 100644 100644 aaa bbb ccc file",
+		},
+		{
+			name:   "invalid ahead behind",
+			out:    "# branch.ab 1\x00",
+			record: "# branch.ab 1",
+		},
+		{
+			name:   "invalid stash count",
+			out:    "# stash many\x00",
+			record: "# stash many",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := parseStatus(tc.out, true)
+			if s != nil {
+				t.Errorf("Expected nil status, got %+v", s)
+			}
+			perr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("Expected *ParseError, got %T: %v", err, err)
+			}
+			assertString(t, "Record", tc.record, perr.Record)
+		})
+	}
+}
+
 func TestExecGitErr(t *testing.T) {
 	path := os.Getenv("PATH")
 	os.Setenv("PATH", "")
@@ -194,6 +658,273 @@ func TestExecGitErr(t *testing.T) {
 	}
 }
 
+func TestParseWith(t *testing.T) {
+	expected := &GitStatus{Branch: "fake", Staged: 1}
+	actual, err := ParseWith(StatusFunc(func(context.Context) (*GitStatus, error) {
+		return expected, nil
+	}))
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if actual != expected {
+		t.Errorf("Expected status from source, got %v", actual)
+	}
+
+	_, err = ParseWith(StatusFunc(func(context.Context) (*GitStatus, error) {
+		return nil, errors.New("source failed")
+	}))
+	if err == nil || err.Error() != "source failed" {
+		t.Errorf("Expected error from source, got %v", err)
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	slow := StatusFunc(func(ctx context.Context) (*GitStatus, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	_, err := ParseContext(ctx, slow)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestParseContextCanceled(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		touch test
+	`)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, src := range []StatusSource{ExecSource{}, NativeSource{}} {
+		_, err := ParseContext(ctx, src)
+		if err != context.Canceled {
+			t.Errorf("%T: Expected context canceled, got %v", src, err)
+		}
+	}
+}
+
+func TestParseHeadOnly(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		git commit --allow-empty -m 'initial'
+		mkdir sub
+		touch sub/test
+	`)
+	s, err := ParseHead(path.Join(dir, "sub"))
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	assertString(t, "branch", "master", s.Branch)
+	assertInt(t, "Untracked", 0, s.Untracked)
+	if len(s.Sha) != 40 {
+		t.Errorf("Expected 40 char hash, got %v (%s)", len(s.Sha), s.Sha)
+	}
+
+	s, err = ParseHead(os.TempDir())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if s != nil {
+		t.Errorf("Expected nil return outside repository, got %v", s)
+	}
+}
+
+func TestRepoConfig(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		git config gitprompt.format '%h'
+		git config gitprompt.disabled true
+		git config gitprompt.sub.format ignored
+		mkdir sub
+	`)
+	cfg, err := RepoConfig(path.Join(dir, "sub"))
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	expected := map[string]string{"format": "%h", "disabled": "true"}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Expected %q, got %q", expected, cfg)
+	}
+
+	cfg, err = RepoConfig(os.TempDir())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if cfg != nil {
+		t.Errorf("Expected no config outside a repository, got %q", cfg)
+	}
+}
+
+func TestRepoPaths(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		mkdir sub
+	`)
+	workTree, gitDir, err := RepoPaths(path.Join(dir, "sub"))
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if workTree != dir {
+		t.Errorf("Expected working tree %q, got %q", dir, workTree)
+	}
+	if expected := path.Join(dir, ".git"); gitDir != expected {
+		t.Errorf("Expected git dir %q, got %q", expected, gitDir)
+	}
+
+	workTree, gitDir, err = RepoPaths(os.TempDir())
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if workTree != "" || gitDir != "" {
+		t.Errorf("Expected no paths outside a repository, got %q and %q", workTree, gitDir)
+	}
+}
+
+func TestRefState(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	state := func() string {
+		t.Helper()
+		s, err := RefState(dir)
+		if err != nil {
+			t.Fatalf("Received unexpected error: %v", err)
+		}
+		return s
+	}
+
+	setupCommands(t, dir, `
+		git init
+		git commit --allow-empty -m 'first'
+		git branch base
+		git branch --set-upstream-to=base
+	`)
+	initial := state()
+	if initial == "" {
+		t.Fatalf("Expected a state in a repository")
+	}
+	if state() != initial {
+		t.Errorf("Expected the same state when nothing changed")
+	}
+
+	steps := []struct {
+		name     string
+		commands string
+	}{
+		{"commit", "git commit --allow-empty -m 'second'"},
+		{"move upstream", "git branch -f base HEAD"},
+		{"reset soft", "git reset --soft HEAD^"},
+		{"stash", "touch a && git add a && git stash"},
+		{"stash again", "touch b && git add b && git stash"},
+		{"drop older stash", "git stash drop stash@{1}"},
+		{"pack refs", "git pack-refs --all && git branch -f base HEAD^0 && git commit --allow-empty -m 'third'"},
+	}
+	prev := initial
+	for _, step := range steps {
+		setupCommands(t, dir, step.commands)
+		if s := state(); s == prev {
+			t.Errorf("%s: expected the state to change from %q", step.name, prev)
+		} else {
+			prev = s
+		}
+	}
+
+	if s, err := RefState(os.TempDir()); s != "" || err != nil {
+		t.Errorf("Expected no state outside a repository, got %q, %v", s, err)
+	}
+}
+
+func TestWorkTreeState(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	state := func() string {
+		t.Helper()
+		s, err := WorkTreeState(dir)
+		if err != nil {
+			t.Fatalf("Received unexpected error: %v", err)
+		}
+		return s
+	}
+
+	setupCommands(t, dir, `
+		git init
+		mkdir sub
+		echo a > a
+		echo a > sub/b
+		git add a sub/b
+	`)
+	initial := state()
+	if initial == "" {
+		t.Fatalf("Expected a state in a repository")
+	}
+	if state() != initial {
+		t.Errorf("Expected the same state when nothing changed")
+	}
+
+	steps := []struct {
+		name     string
+		commands string
+	}{
+		{"edit", "echo b >> a"},
+		{"edit in subdirectory", "echo b >> sub/b"},
+		{"add untracked", "touch sub/c"},
+		{"remove", "rm a"},
+		{"stage", "git add -A"},
+	}
+	prev := initial
+	for _, step := range steps {
+		// Not run through setupCommands, which writes a script to dir.
+		cmd := exec.Command("bash", "-c", step.commands)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", step.name, err, out)
+		}
+		if s := state(); s == prev {
+			t.Errorf("%s: expected the state to change from %q", step.name, prev)
+		} else {
+			prev = s
+		}
+	}
+
+	if s, err := WorkTreeState(os.TempDir()); s != "" || err != nil {
+		t.Errorf("Expected no state outside a repository, got %q, %v", s, err)
+	}
+}
+
+func TestParseWithDefault(t *testing.T) {
+	dir, done := setupTestDir(t)
+	defer done()
+
+	setupCommands(t, dir, `
+		git init
+		touch test
+	`)
+	s, err := ParseWith(nil)
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	assertString(t, "branch", "master", s.Branch)
+	assertInt(t, "Untracked", 1, s.Untracked)
+}
+
 func setupTestDir(t *testing.T) (string, func()) {
 	dir, err := ioutil.TempDir("", "gitprompt-test")
 	if err != nil {
@@ -260,6 +991,14 @@ func assertString(t *testing.T, name, expected, actual string) {
 	t.Errorf("%s does not match\n\tExpected: %q\n\tActual:   %q", name, expected, actual)
 }
 
+func assertBool(t *testing.T, name string, expected, actual bool) {
+	t.Helper()
+	if expected == actual {
+		return
+	}
+	t.Errorf("%s does not match\n\tExpected: %v\n\tActual:   %v", name, expected, actual)
+}
+
 func assertInt(t *testing.T, name string, expected, actual int) {
 	t.Helper()
 	if expected == actual {
@@ -267,3 +1006,67 @@ func assertInt(t *testing.T, name string, expected, actual int) {
 	}
 	t.Errorf("%s does not match\n\tExpected: %v\n\tActual:   %v", name, expected, actual)
 }
+
+func TestGitStatusJSON(t *testing.T) {
+	s := &GitStatus{
+		Sha:       "0455b83f923a40f0b485665c44aa068bc25029f5",
+		Branch:    "master",
+		Staged:    1,
+		Conflicts: 1,
+		Index:     Changes{Renamed: 1},
+		Changed:   2,
+		Upstream:  "origin/master",
+		Operation: Merge,
+		Files: []FileStatus{
+			{Path: "new", OrigPath: "old", Index: StateRenamed, Worktree: StateUnmodified},
+			{Path: "conflict", Index: StateUnmerged, Worktree: StateUnmerged, Conflict: BothModified},
+		},
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	expected := `{"sha":"0455b83f923a40f0b485665c44aa068bc25029f5","branch":"master",` +
+		`"untracked":0,"modified":0,"staged":1,"conflicts":1,` +
+		`"index":{"modified":0,"added":0,"deleted":0,"renamed":1,"copied":0,"type_changed":0},` +
+		`"worktree":{"modified":0,"added":0,"deleted":0,"renamed":0,"copied":0,"type_changed":0},` +
+		`"changed":2,"ahead":0,"behind":0,"stashes":0,"upstream":"origin/master","upstream_gone":false,` +
+		`"operation":"merge","step":0,"steps":0,"timed_out":false,"files":[` +
+		`{"path":"new","orig_path":"old","index":"R","worktree":".","submodule":false,"conflict":""},` +
+		`{"path":"conflict","orig_path":"","index":"U","worktree":"U","submodule":false,"conflict":"both modified"}]}`
+	if string(b) != expected {
+		t.Errorf("JSON does not match\n\tExpected: %s\n\tActual:   %s", expected, b)
+	}
+
+	var decoded GitStatus
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, s) {
+		t.Errorf("Decoded status does not match\n\tExpected: %+v\n\tActual:   %+v", s, &decoded)
+	}
+
+	b, err = json.Marshal(&GitStatus{})
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if bytes.Contains(b, []byte(`"files"`)) {
+		t.Errorf("Expected no files, got %s", b)
+	}
+}
+
+func TestFileStateText(t *testing.T) {
+	var state FileState
+	for _, text := range []string{"", "MM"} {
+		if err := state.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("Expected error for %q", text)
+		}
+	}
+	var conflict ConflictType
+	if err := conflict.UnmarshalText([]byte("both confused")); err == nil {
+		t.Errorf("Expected error for unknown conflict type")
+	}
+	if _, err := ConflictType(100).MarshalText(); err == nil {
+		t.Errorf("Expected error for unknown conflict type")
+	}
+}
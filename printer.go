@@ -1,7 +1,6 @@
 package gitprompt
 
 import (
-	"bufio"
 	"bytes"
 	"io"
 	"log"
@@ -13,23 +12,45 @@ import (
 const (
 	tAttribute rune = '@'
 	tColor     rune = '#'
+	tBg        rune = '^' // after tColor, as in #^b
 	tReset     rune = '_'
 	tData      rune = '%'
+	tNameOp    rune = '{'
+	tNameCl    rune = '}'
 	tGroupOp   rune = '['
 	tGroupCl   rune = ']'
+	tCond      rune = '?'
+	tElse      rune = '|'
 	tEsc       rune = '\\'
 )
 
-var attrs = map[rune]uint8{
-	'b': 1, // bold
-	'f': 2, // faint
-	'i': 3, // italic
+var attrs = map[rune]attribute{
+	'b': attrBold,
+	'f': attrFaint,
+	'i': attrItalic,
+	'k': attrBlink,
+	'r': attrReverse,
+	's': attrStrike,
+	'o': attrOverline,
 }
 
-var resetAttrs = map[rune]uint8{
-	'B': 1, // bold
-	'F': 2, // faint
-	'I': 3, // italic
+var resetAttrs = map[rune]attribute{
+	'B': attrBold,
+	'F': attrFaint,
+	'I': attrItalic,
+	'K': attrBlink,
+	'R': attrReverse,
+	'S': attrStrike,
+	'O': attrOverline,
+}
+
+// underlines are the underline styles that can be set with @{name}.
+var underlines = map[string]underline{
+	"single": underlineSingle,
+	"double": underlineDouble,
+	"curly":  underlineCurly,
+	"dotted": underlineDotted,
+	"dashed": underlineDashed,
 }
 
 var colors = map[rune]uint8{
@@ -59,6 +80,18 @@ const (
 	conflicts rune = 'c'
 	ahead     rune = 'a'
 	behind    rune = 'b'
+	stashes   rune = 'S'
+	operation rune = 'o'
+	progress  rune = 'p'
+	upstream  rune = 'r'
+	gone      rune = 'g'
+	timedOut  rune = 't'
+)
+
+// Default separators between segments, the powerline arrows.
+const (
+	DefaultSeparator     = "\ue0b0"
+	DefaultThinSeparator = "\ue0b1"
 )
 
 type group struct {
@@ -70,146 +103,60 @@ type group struct {
 	hasData  bool
 	hasValue bool
 	width    int
-}
-
-// Print prints the status according to the format.
-//
-// The integer returned is the print width of the string.
-func Print(s *GitStatus, format string) (string, int) {
-	if s == nil {
-		return "", 0
-	}
-
-	in := make(chan rune)
-	go func() {
-		r := bufio.NewReader(strings.NewReader(format))
-		for {
-			ch, _, err := r.ReadRune()
-			if err != nil {
-				close(in)
-				return
-			}
-			in <- ch
-		}
-	}()
-
-	return buildOutput(s, in)
-}
-
-func buildOutput(s *GitStatus, in chan rune) (string, int) {
-	root := &group{}
-	g := root
 
-	col := false
-	att := false
-	dat := false
-	esc := false
+	printer *Printer
 
-	for ch := range in {
-		if esc {
-			esc = false
-			g.addRune(ch)
-			continue
-		}
-
-		if col {
-			setColor(g, ch)
-			col = false
-			continue
-		}
+	// segment is set if the group is a segment.
+	segment bool
 
-		if att {
-			setAttribute(g, ch)
-			att = false
-			continue
-		}
-
-		if dat {
-			setData(g, s, ch)
-			dat = false
-			continue
-		}
-
-		switch ch {
-		case tEsc:
-			esc = true
-		case tColor:
-			col = true
-		case tAttribute:
-			att = true
-		case tData:
-			dat = true
-		case tGroupOp:
-			g = &group{
-				parent: g,
-				format: g.format,
-			}
-			g.format.clearAttributes()
-			g.format.clearColor()
-		case tGroupCl:
-			if g.writeTo(&g.parent.buf) {
-				g.parent.format = g.format
-				g.parent.format.setColor(0)
-				g.parent.format.clearAttributes()
-				g.parent.width += g.width
-			}
-			g = g.parent
-		default:
-			g.addRune(ch)
-		}
-	}
+	// show is set to show the group even if its data has no value.
+	show bool
 
-	// trailing characters
-	if col {
-		g.addRune(tColor)
-	}
-	if att {
-		g.addRune(tAttribute)
-	}
-	if dat {
-		g.addRune(tData)
-	}
+	// sep is set if a separator should be printed before what comes next,
+	// after a segment with the foreground sepColor and background sepBg.
+	sep      bool
+	sepColor color
+	sepBg    color
+}
 
-	g.format.clearColor()
-	g.format.clearAttributes()
-	g.format.printANSI(&g.buf)
+// Printer prints the status according to a format, with options for how
+// it's printed. The zero value is ready to use.
+type Printer struct {
+	// Separator is printed between segments with different backgrounds,
+	// colored to make the background of one flow into the next. Defaults to
+	// DefaultSeparator.
+	Separator string
+	// ThinSeparator is printed between segments with the same background.
+	// Defaults to DefaultThinSeparator.
+	ThinSeparator string
+	// Shell is the shell the output is printed for. Escape codes are
+	// wrapped so the shell knows they have no width.
+	Shell Shell
+}
 
-	return root.buf.String(), root.width
+// Print prints the status according to the format.
+//
+// The integer returned is the print width of the string.
+func Print(s *GitStatus, format string) (string, int) {
+	return (&Printer{}).Print(s, format)
 }
 
-func setColor(g *group, ch rune) {
-	if ch == tReset {
-		// Reset color code.
-		g.format.clearColor()
-		return
-	}
-	code, ok := colors[ch]
-	if ok {
-		g.format.setColor(code)
-		return
-	}
-	g.addRune(tColor)
-	g.addRune(ch)
+// Print prints the status according to the format.
+//
+// The integer returned is the print width of the string.
+func (p *Printer) Print(s *GitStatus, format string) (string, int) {
+	return p.Render(compile(format), s)
 }
 
-func setAttribute(g *group, ch rune) {
-	if ch == tReset {
-		// Reset attribute.
-		g.format.clearAttributes()
-		return
+func (p *Printer) separators() (string, string) {
+	sep, thin := p.Separator, p.ThinSeparator
+	if sep == "" {
+		sep = DefaultSeparator
 	}
-	code, ok := attrs[ch]
-	if ok {
-		g.format.setAttribute(code)
-		return
+	if thin == "" {
+		thin = DefaultThinSeparator
 	}
-	code, ok = resetAttrs[ch]
-	if ok {
-		g.format.clearAttribute(code)
-		return
-	}
-	g.addRune(tAttribute)
-	g.addRune(ch)
+	return sep, thin
 }
 
 func setData(g *group, s *GitStatus, ch rune) {
@@ -258,14 +205,173 @@ func setData(g *group, s *GitStatus, ch rune) {
 		if s.Behind > 0 {
 			g.hasValue = true
 		}
-	default:
-		g.addRune(tData)
-		g.addRune(ch)
+	case stashes:
+		g.addInt(s.Stashes)
+		g.hasData = true
+		if s.Stashes > 0 {
+			g.hasValue = true
+		}
+	case operation:
+		g.hasData = true
+		if s.Operation != NoOperation {
+			g.hasValue = true
+			g.addString(strings.ToUpper(string(s.Operation)))
+		}
+	case progress:
+		g.hasData = true
+		if s.Steps > 0 {
+			g.hasValue = true
+			g.addString(strconv.Itoa(s.Step) + "/" + strconv.Itoa(s.Steps))
+		}
+	case upstream:
+		g.hasData = true
+		if s.Upstream != "" {
+			g.hasValue = true
+			g.addString(s.Upstream)
+		}
+	case gone:
+		// Prints nothing, only shows the group if the upstream is gone.
+		g.hasData = true
+		if s.UpstreamGone {
+			g.hasValue = true
+		}
+	case timedOut:
+		// Prints nothing, only shows the group if the status is incomplete.
+		g.hasData = true
+		if s.TimedOut {
+			g.hasValue = true
+		}
+	}
+}
+
+// isData returns true if ch is a data token.
+func isData(ch rune) bool {
+	switch ch {
+	case head, untracked, modified, staged, conflicts, ahead, behind,
+		stashes, operation, progress, upstream, gone, timedOut:
+		return true
+	}
+	return false
+}
+
+// values are the numbers that can be printed with %{name} and used in
+// conditions. Flags are 1 if set and 0 otherwise.
+var values = map[string]func(s *GitStatus) int{
+	"staged":               func(s *GitStatus) int { return s.Staged },
+	"modified":             func(s *GitStatus) int { return s.Modified },
+	"untracked":            func(s *GitStatus) int { return s.Untracked },
+	"conflicts":            func(s *GitStatus) int { return s.Conflicts },
+	"ahead":                func(s *GitStatus) int { return s.Ahead },
+	"behind":               func(s *GitStatus) int { return s.Behind },
+	"stashes":              func(s *GitStatus) int { return s.Stashes },
+	"changed":              func(s *GitStatus) int { return s.Changed },
+	"step":                 func(s *GitStatus) int { return s.Step },
+	"steps":                func(s *GitStatus) int { return s.Steps },
+	"detached":             func(s *GitStatus) int { return boolInt(s.Branch == "") },
+	"upstream":             func(s *GitStatus) int { return boolInt(s.Upstream != "") },
+	"gone":                 func(s *GitStatus) int { return boolInt(s.UpstreamGone) },
+	"operation":            func(s *GitStatus) int { return boolInt(s.Operation != NoOperation) },
+	"timedout":             func(s *GitStatus) int { return boolInt(s.TimedOut) },
+	"index.modified":       func(s *GitStatus) int { return s.Index.Modified },
+	"index.added":          func(s *GitStatus) int { return s.Index.Added },
+	"index.deleted":        func(s *GitStatus) int { return s.Index.Deleted },
+	"index.renamed":        func(s *GitStatus) int { return s.Index.Renamed },
+	"index.copied":         func(s *GitStatus) int { return s.Index.Copied },
+	"index.typechanged":    func(s *GitStatus) int { return s.Index.TypeChanged },
+	"worktree.modified":    func(s *GitStatus) int { return s.Worktree.Modified },
+	"worktree.added":       func(s *GitStatus) int { return s.Worktree.Added },
+	"worktree.deleted":     func(s *GitStatus) int { return s.Worktree.Deleted },
+	"worktree.renamed":     func(s *GitStatus) int { return s.Worktree.Renamed },
+	"worktree.copied":      func(s *GitStatus) int { return s.Worktree.Copied },
+	"worktree.typechanged": func(s *GitStatus) int { return s.Worktree.TypeChanged },
+}
+
+// flags are the flags that can be used with %{name}, which print nothing but
+// show the group if the flag is set. They can also be used in conditions.
+var flags = map[string]func(s *GitStatus) bool{
+	"clean": (*GitStatus).Clean,
+	"dirty": (*GitStatus).Dirty,
+}
+
+func setNamedData(g *group, s *GitStatus, name string) {
+	if flag, ok := flags[name]; ok {
+		g.hasData = true
+		if flag(s) {
+			g.hasValue = true
+		}
+		return
+	}
+	n := values[name](s)
+	g.addInt(n)
+	g.hasData = true
+	if n > 0 {
+		g.hasValue = true
+	}
+}
+
+// open opens a group or segment in the group.
+func (g *group) open(segment bool) *group {
+	child := &group{
+		parent:  g,
+		format:  g.format,
+		printer: g.printer,
+		segment: segment,
+	}
+	child.format.clearAttributes()
+	child.format.clearColor()
+	child.format.clearBackground()
+	if segment && g.sep {
+		// A separator is printed before the segment if it's shown, so the
+		// terminal state is not known.
+		child.format.dirty = true
+	} else if !segment {
+		// What the group prints first, or its first segment, makes the
+		// transition from the previous segment.
+		child.sep = g.sep
+		child.sepColor = g.sepColor
+		child.sepBg = g.sepBg
+	}
+	return child
+}
+
+// close writes the group to its parent if it's visible, and returns the
+// parent.
+func (g *group) close() *group {
+	parent := g.parent
+	if !g.visible() {
+		return parent
+	}
+	if g.segment {
+		parent.separate(g.format.bg, true)
 	}
+	g.writeTo(&parent.buf)
+	if g.segment {
+		parent.sep = true
+		parent.sepColor = g.format.color
+		parent.sepBg = g.format.bg
+	} else {
+		// The group either printed the separator it took over, or ended with
+		// a segment of its own.
+		parent.sep = g.sep
+		parent.sepColor = g.sepColor
+		parent.sepBg = g.sepBg
+	}
+	parent.format = g.format
+	parent.format.clearColor()
+	parent.format.clearBackground()
+	parent.format.clearAttributes()
+	parent.width += g.width
+	return parent
+}
+
+// visible returns true if the group should be printed: it has no data, or
+// at least one data token has a value.
+func (g *group) visible() bool {
+	return g.show || !g.hasData || g.hasValue
 }
 
 func (g *group) writeTo(b io.Writer) bool {
-	if g.hasData && !g.hasValue {
+	if !g.visible() {
 		return false
 	}
 	if _, err := g.buf.WriteTo(b); err != nil {
@@ -274,18 +380,55 @@ func (g *group) writeTo(b io.Writer) bool {
 	return true
 }
 
+// separate prints the separator after the previous segment, if any, before
+// something with the background next is printed. Between segments, the thin
+// separator is used if the backgrounds are the same. Before anything else,
+// the separator is only needed if the background changes.
+func (g *group) separate(next color, segment bool) {
+	if !g.sep {
+		return
+	}
+	g.sep = false
+	if !segment && next == g.sepBg {
+		return
+	}
+	sep, thin := g.printer.separators()
+
+	f := g.format
+	g.format.clearAttributes()
+	if next == g.sepBg {
+		g.format.setColor(g.sepColor)
+		sep = thin
+	} else {
+		g.format.setColor(g.sepBg)
+	}
+	g.format.setBackground(next)
+	g.addString(sep)
+
+	// Keep the state of the terminal, but restore the format.
+	f.currentColor = g.format.currentColor
+	f.currentBg = g.format.currentBg
+	f.currentAttr = g.format.currentAttr
+	f.currentUnderline = g.format.currentUnderline
+	g.format = f
+}
+
 func (g *group) addRune(r rune) {
-	if !unicode.IsSpace(r) {
+	g.separate(g.format.bg, false)
+	// Formatting can wait until the next visible character, unless the
+	// whitespace has a different background.
+	if !unicode.IsSpace(r) || g.format.bg != g.format.currentBg || g.format.dirty {
 		g.format.printANSI(&g.buf)
 	}
-	g.width++
-	g.buf.WriteRune(r)
+	g.width += runeWidth(r)
+	g.buf.WriteString(g.format.shell.escape(string(r)))
 }
 
 func (g *group) addString(s string) {
+	g.separate(g.format.bg, false)
 	g.format.printANSI(&g.buf)
-	g.width += len(s)
-	g.buf.WriteString(s)
+	g.width += stringWidth(s)
+	g.buf.WriteString(g.format.shell.escape(s))
 }
 
 func (g *group) addInt(i int) {
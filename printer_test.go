@@ -1,6 +1,9 @@
 package gitprompt
 
 import (
+	"os"
+	"os/exec"
+	"path"
 	"testing"
 )
 
@@ -13,6 +16,7 @@ var all = &GitStatus{
 	Conflicts: 3,
 	Ahead:     4,
 	Behind:    5,
+	Stashes:   6,
 }
 
 func TestPrinterEmpty(t *testing.T) {
@@ -27,10 +31,187 @@ func TestPrinterData(t *testing.T) {
 	assertWidth(t, 18, w)
 }
 
+func TestPrinterStashes(t *testing.T) {
+	actual, w := Print(all, "%S")
+	assertOutput(t, "6", actual)
+	assertWidth(t, 1, w)
+}
+
 func TestPrinterUnicode(t *testing.T) {
 	actual, w := Print(all, "%h ✋%u ⚡️%m 🚚%s ❗️%c ⬆%a ⬇%b")
 	assertOutput(t, "master ✋0 ⚡️1 🚚2 ❗️3 ⬆4 ⬇5", actual)
-	assertWidth(t, 26, w)
+	assertWidth(t, 28, w)
+}
+
+func TestPrinterWidth(t *testing.T) {
+	tests := []struct {
+		name   string
+		branch string
+		format string
+		width  int
+	}{
+		{
+			name:   "ascii",
+			branch: "feature/x",
+			format: "%h",
+			width:  9,
+		},
+		{
+			name:   "cjk branch",
+			branch: "機能/テスト",
+			format: "%h",
+			width:  11,
+		},
+		{
+			name:   "hangul branch",
+			branch: "기능",
+			format: "%h",
+			width:  4,
+		},
+		{
+			name:   "combining accent",
+			branch: "cafe\u0301",
+			format: "%h",
+			width:  4,
+		},
+		{
+			name:   "emoji branch",
+			branch: "🚀-launch",
+			format: "%h",
+			width:  9,
+		},
+		{
+			name:   "zero width joiner",
+			branch: "a\u200db",
+			format: "%h",
+			width:  2,
+		},
+		{
+			name:   "wide format",
+			branch: "master",
+			format: "【%h】",
+			width:  10,
+		},
+		{
+			name:   "emoji with variation selector",
+			branch: "master",
+			format: "⚡️%h",
+			width:  8,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, w := Print(&GitStatus{Branch: test.branch}, test.format)
+			assertWidth(t, test.width, w)
+		})
+	}
+}
+
+func TestPrinterTimedOut(t *testing.T) {
+	actual, w := Print(all, "%h[ …%t]")
+	assertOutput(t, "master", actual)
+	assertWidth(t, 6, w)
+
+	actual, w = Print(&GitStatus{Branch: "master", TimedOut: true}, "%h[ …%t]")
+	assertOutput(t, "master …", actual)
+	assertWidth(t, 8, w)
+}
+
+func TestPrinterOperation(t *testing.T) {
+	rebase := &GitStatus{Branch: "master", Operation: Rebase, Step: 3, Steps: 7}
+	actual, w := Print(rebase, "%h[ %o[ %p]]")
+	assertOutput(t, "master REBASE 3/7", actual)
+	assertWidth(t, 17, w)
+
+	merge := &GitStatus{Branch: "master", Operation: Merge}
+	actual, w = Print(merge, "%h[ %o[ %p]]")
+	assertOutput(t, "master MERGE", actual)
+	assertWidth(t, 12, w)
+
+	actual, w = Print(all, "%h[ %o[ %p]]")
+	assertOutput(t, "master", actual)
+	assertWidth(t, 6, w)
+}
+
+func TestPrinterUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   *GitStatus
+		expected string
+	}{
+		{
+			name:     "no upstream",
+			status:   &GitStatus{Branch: "master"},
+			expected: "master",
+		},
+		{
+			name:     "in sync",
+			status:   &GitStatus{Branch: "master", Upstream: "origin/master"},
+			expected: "master → origin/master",
+		},
+		{
+			name:     "gone",
+			status:   &GitStatus{Branch: "master", Upstream: "origin/master", UpstreamGone: true},
+			expected: "master → origin/master ✗",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, _ := Print(test.status, "%h[ → %r][ ✗%g]")
+			assertOutput(t, test.expected, actual)
+		})
+	}
+}
+
+func TestPrinterChanges(t *testing.T) {
+	s := &GitStatus{
+		Branch:   "master",
+		Staged:   3,
+		Modified: 1,
+		Index:    Changes{Modified: 1, Added: 2},
+		Worktree: Changes{Deleted: 1},
+	}
+	tests := []struct {
+		name     string
+		format   string
+		expected string
+		width    int
+	}{
+		{
+			name:     "counts",
+			format:   "%h %{index.modified} %{index.added} %{index.deleted} %{worktree.deleted}",
+			expected: "master 1 2 0 1",
+			width:    14,
+		},
+		{
+			name:     "groups",
+			format:   "%h[ +%{index.added}][ -%{index.deleted}][ !%{worktree.deleted}]",
+			expected: "master +2 !1",
+			width:    12,
+		},
+		{
+			name:     "unknown",
+			format:   "%{nope}%h",
+			expected: "%{nope}master",
+			width:    13,
+		},
+		{
+			name:     "unterminated",
+			format:   "%h%{index.added",
+			expected: "master%{index.added",
+			width:    19,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, w := Print(s, test.format)
+			assertOutput(t, test.expected, actual)
+			assertWidth(t, test.width, w)
+		})
+	}
 }
 
 func TestShortSHA(t *testing.T) {
@@ -91,9 +272,63 @@ func TestPrinterColorAttributes(t *testing.T) {
 		{
 			name:     "reset attribute",
 			format:   "#ggreen @b@igreen_bold_italic @Bgreen_italic",
-			expected: "\x1b[32mgreen \x1b[1;3mgreen_bold_italic \x1b[0;3;32mgreen_italic\x1b[0m",
+			expected: "\x1b[32mgreen \x1b[1;3mgreen_bold_italic \x1b[22mgreen_italic\x1b[0m",
 			width:    36,
 		},
+		{
+			name:     "256 colors",
+			format:   "#{208}%h",
+			expected: "\x1b[38;5;208mmaster\x1b[0m",
+			width:    6,
+		},
+		{
+			name:     "rgb",
+			format:   "#{ff8800}%h",
+			expected: "\x1b[38;2;255;136;0mmaster\x1b[0m",
+			width:    6,
+		},
+		{
+			name:     "rgb & attribute",
+			format:   "@b#{0080FF}A",
+			expected: "\x1b[1;38;2;0;128;255mA\x1b[0m",
+			width:    1,
+		},
+		{
+			name:     "same color",
+			format:   "#{208}A#{208}B#{ff8800}C#{ff8800}D",
+			expected: "\x1b[38;5;208mAB\x1b[38;2;255;136;0mCD\x1b[0m",
+			width:    4,
+		},
+		{
+			name:     "basic after rgb",
+			format:   "#{ff8800}A#rB",
+			expected: "\x1b[38;2;255;136;0mA\x1b[31mB\x1b[0m",
+			width:    2,
+		},
+		{
+			name:     "reset color keeps attributes",
+			format:   "@b#{12}A#_B",
+			expected: "\x1b[1;38;5;12mA\x1b[39mB\x1b[0m",
+			width:    2,
+		},
+		{
+			name:     "invalid color index",
+			format:   "#{256}A",
+			expected: "#{256}A",
+			width:    7,
+		},
+		{
+			name:     "invalid color",
+			format:   "#{orange}A",
+			expected: "#{orange}A",
+			width:    10,
+		},
+		{
+			name:     "unterminated color",
+			format:   "A#{ff88",
+			expected: "A#{ff88",
+			width:    7,
+		},
 		{
 			name:     "ending with #",
 			format:   "%h#",
@@ -123,6 +358,92 @@ func TestPrinterColorAttributes(t *testing.T) {
 	}
 }
 
+func TestPrinterAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		expected string
+	}{
+		{
+			name:     "underline",
+			format:   "#g@uA@UB",
+			expected: "\x1b[4;32mA\x1b[24mB\x1b[0m",
+		},
+		{
+			name:     "blink",
+			format:   "#g@kA@KB",
+			expected: "\x1b[5;32mA\x1b[25mB\x1b[0m",
+		},
+		{
+			name:     "reverse",
+			format:   "#g@rA@RB",
+			expected: "\x1b[7;32mA\x1b[27mB\x1b[0m",
+		},
+		{
+			name:     "strikethrough",
+			format:   "#g@sA@SB",
+			expected: "\x1b[9;32mA\x1b[29mB\x1b[0m",
+		},
+		{
+			name:     "overline",
+			format:   "#g@oA@OB",
+			expected: "\x1b[53;32mA\x1b[55mB\x1b[0m",
+		},
+		{
+			name:     "italic",
+			format:   "#g@iA@IB",
+			expected: "\x1b[3;32mA\x1b[23mB\x1b[0m",
+		},
+		{
+			name:     "underline styles",
+			format:   "@{double}A@{curly}B@{dotted}C@{dashed}D@{single}E",
+			expected: "\x1b[4:2mA\x1b[4:3mB\x1b[4:4mC\x1b[4:5mD\x1b[4mE\x1b[0m",
+		},
+		{
+			name:     "same underline",
+			format:   "@{curly}A@{curly}B",
+			expected: "\x1b[4:3mAB\x1b[0m",
+		},
+		{
+			name:     "clear bold keeps faint",
+			format:   "@b@fA@BB",
+			expected: "\x1b[1;2mA\x1b[22;2mB\x1b[0m",
+		},
+		{
+			name:     "clear bold and faint",
+			format:   "@b@f@iA@B@FB",
+			expected: "\x1b[1;2;3mA\x1b[22mB\x1b[0m",
+		},
+		{
+			name:     "clear and set",
+			format:   "@r#gA@R@sB",
+			expected: "\x1b[7;32mA\x1b[27;9mB\x1b[0m",
+		},
+		{
+			name:     "reset all attributes",
+			format:   "#g@s@uA@_B",
+			expected: "\x1b[9;4;32mA\x1b[29;24mB\x1b[0m",
+		},
+		{
+			name:     "group",
+			format:   "@u[@s%h]A",
+			expected: "\x1b[9mmaster\x1b[0mA",
+		},
+		{
+			name:     "unknown style",
+			format:   "@{wavy}A",
+			expected: "@{wavy}A",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, _ := Print(all, test.format)
+			assertOutput(t, test.expected, actual)
+		})
+	}
+}
+
 func TestPrinterGroups(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -136,6 +457,12 @@ func TestPrinterGroups(t *testing.T) {
 			expected: "<master B5 A4 C3>",
 			width:    17,
 		},
+		{
+			name:     "stashes",
+			format:   "%h[ ≡%S]",
+			expected: "master ≡6",
+			width:    9,
+		},
 		{
 			name:     "group color",
 			format:   "<[#r%h]-[#g%u]%a[-#b%b]>",
@@ -153,6 +480,415 @@ func TestPrinterGroups(t *testing.T) {
 	}
 }
 
+func TestPrinterBackground(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		expected string
+		width    int
+	}{
+		{
+			name:     "background",
+			format:   "#^b%h",
+			expected: "\x1b[44mmaster\x1b[0m",
+			width:    6,
+		},
+		{
+			name:     "highlight background",
+			format:   "#^BA",
+			expected: "\x1b[104mA\x1b[0m",
+			width:    1,
+		},
+		{
+			name:     "256 colors",
+			format:   "#^{236}A",
+			expected: "\x1b[48;5;236mA\x1b[0m",
+			width:    1,
+		},
+		{
+			name:     "rgb",
+			format:   "#^{303030}A",
+			expected: "\x1b[48;2;48;48;48mA\x1b[0m",
+			width:    1,
+		},
+		{
+			name:     "foreground and background",
+			format:   "#w#^bA#^rB#kC",
+			expected: "\x1b[37;44mA\x1b[41mB\x1b[30mC\x1b[0m",
+			width:    3,
+		},
+		{
+			name:     "whitespace",
+			format:   "#^b %h #^_ A",
+			expected: "\x1b[44m master \x1b[0m A",
+			width:    10,
+		},
+		{
+			name:     "reset background keeps color",
+			format:   "#r#^bA#^_B",
+			expected: "\x1b[31;44mA\x1b[49mB\x1b[0m",
+			width:    2,
+		},
+		{
+			name:     "clear attribute keeps background",
+			format:   "@b#^bA@BB",
+			expected: "\x1b[1;44mA\x1b[22mB\x1b[0m",
+			width:    2,
+		},
+		{
+			name:     "group",
+			format:   "[#^b %h ][#^g %a ][#^r %u ]",
+			expected: "\x1b[44m master \x1b[42m 4 \x1b[0m",
+			width:    11,
+		},
+		{
+			name:     "invalid",
+			format:   "#^x#^{nope}#^",
+			expected: "#^x#^{nope}#^",
+			width:    13,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, w := Print(all, test.format)
+			assertOutput(t, test.expected, actual)
+			assertWidth(t, test.width, w)
+		})
+	}
+}
+
+func TestPrinterSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		expected string
+		width    int
+	}{
+		{
+			name:     "backgrounds",
+			format:   "#[#w#^b %h ]#[#k#^y %s ]#[#k#^r %u ]#[#w#^m %c ]",
+			expected: "\x1b[37;44m master \x1b[34;43m>\x1b[0;30;43m 2 \x1b[33;45m>\x1b[0;37;45m 3 \x1b[35;49m>\x1b[0m",
+			width:    17,
+		},
+		{
+			name:     "same background",
+			format:   "#[#w#^b %h ]#[#k#^b %s ]",
+			expected: "\x1b[37;44m master |\x1b[0;30;44m 2 \x1b[34;49m>\x1b[0m",
+			width:    13,
+		},
+		{
+			name:     "no background",
+			format:   "#[%h]#[%s]",
+			expected: "master|\x1b[0m2",
+			width:    8,
+		},
+		{
+			name:     "text after segment",
+			format:   "#[#w#^b %h ] x",
+			expected: "\x1b[37;44m master \x1b[34;49m> \x1b[0mx",
+			width:    11,
+		},
+		{
+			name:     "hidden group between segments",
+			format:   "#[#w#^b %h ][ %u]#[#k#^g %a ]",
+			expected: "\x1b[37;44m master \x1b[34;42m>\x1b[0;30;42m 4 \x1b[32;49m>\x1b[0m",
+			width:    13,
+		},
+		{
+			name:     "hidden segment",
+			format:   "#[#w#^b %h ]#[#k#^y %u ]#[#k#^g %a ]",
+			expected: "\x1b[37;44m master \x1b[34;42m>\x1b[0;30;42m 4 \x1b[32;49m>\x1b[0m",
+			width:    13,
+		},
+		{
+			name:     "segment in group",
+			format:   "[#[#w#^b %h ]]#[#k#^g %a ]",
+			expected: "\x1b[37;44m master \x1b[34;42m>\x1b[0;30;42m 4 \x1b[32;49m>\x1b[0m",
+			width:    13,
+		},
+		{
+			name:     "segment in group after segment",
+			format:   "#[#w#^b %h ][#[#k#^r %S ]]#[#k#^g %a ]",
+			expected: "\x1b[37;44m master \x1b[34;41m>\x1b[0;30;41m 6 \x1b[31;42m>\x1b[0;30;42m 4 \x1b[32;49m>\x1b[0m",
+			width:    17,
+		},
+		{
+			name:     "segment in nested group after segment",
+			format:   "#[#w#^b %h ][[#[#k#^r %S ]]]",
+			expected: "\x1b[37;44m master \x1b[34;41m>\x1b[0;30;41m 6 \x1b[31;49m>\x1b[0m",
+			width:    13,
+		},
+		{
+			name:     "segment in conditional after segment",
+			format:   "#[#w#^b %h ][?{staged}#[#k#^g %s ]|#[#k#^r %m ]]",
+			expected: "\x1b[37;44m master \x1b[34;42m>\x1b[0;30;42m 2 \x1b[32;49m>\x1b[0m",
+			width:    13,
+		},
+		{
+			name:     "segment in else branch after segment",
+			format:   "#[#w#^b %h ][?{staged == 0}#[#k#^g %s ]|#[#k#^r %m ]]#[#k#^g %a ]",
+			expected: "\x1b[37;44m master \x1b[34;41m>\x1b[0;30;41m 1 \x1b[31;42m>\x1b[0;30;42m 4 \x1b[32;49m>\x1b[0m",
+			width:    17,
+		},
+		{
+			name:     "unmatched",
+			format:   "a}b",
+			expected: "a}b",
+			width:    3,
+		},
+	}
+
+	p := &Printer{Separator: ">", ThinSeparator: "|"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, w := p.Print(all, test.format)
+			assertOutput(t, test.expected, actual)
+			assertWidth(t, test.width, w)
+		})
+	}
+}
+
+func TestPrinterDefaultSeparators(t *testing.T) {
+	actual, w := Print(all, "#[#^b%h]#[#^b%s]")
+	assertOutput(t, "\x1b[44mmaster"+DefaultThinSeparator+"\x1b[0;44m2\x1b[34;49m"+DefaultSeparator+"\x1b[0m", actual)
+	assertWidth(t, 9, w)
+}
+
+func TestPrinterShell(t *testing.T) {
+	tests := []struct {
+		shell    Shell
+		expected string
+	}{
+		{
+			shell:    ShellPlain,
+			expected: "\x1b[31m100%\\o/ \x1b[0m1",
+		},
+		{
+			shell:    ShellZsh,
+			expected: "%{\x1b[31m%}100%%\\o/ %{\x1b[0m%}1",
+		},
+		{
+			shell:    ShellBash,
+			expected: "\\[\x1b[31m\\]100%\\\\\\\\o/ \\[\x1b[0m\\]1",
+		},
+		{
+			shell:    ShellReadline,
+			expected: "\x01\x1b[31m\x02100%\\o/ \x01\x1b[0m\x021",
+		},
+		{
+			shell:    ShellFish,
+			expected: "\x1b[31m100%\\o/ \x1b[0m1",
+		},
+	}
+
+	s := &GitStatus{Branch: `100%\o/`, Staged: 1}
+	for _, test := range tests {
+		t.Run(test.shell.String(), func(t *testing.T) {
+			p := &Printer{Shell: test.shell}
+			actual, w := p.Print(s, "[#r%h] %s")
+			assertOutput(t, test.expected, actual)
+			assertWidth(t, 9, w)
+		})
+	}
+}
+
+func TestPrinterShellHostileBranch(t *testing.T) {
+	branch := "$(touch${IFS}x)`id`\\$HOME!"
+	s := &GitStatus{Branch: branch}
+
+	p := &Printer{Shell: ShellBash}
+	actual, _ := p.Print(s, "%h")
+	assertOutput(t, "\\\\$(touch\\\\${IFS}x)\\`id\\`\\\\\\\\\\\\$HOME\\041", actual)
+
+	// bash 4.4 and later can expand a prompt with ${PS1@P}.
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	dir, done := setupTestDir(t)
+	defer done()
+	out, err := exec.Command(bash, "-c", `PS1=$1; printf %s "${PS1@P}"`, "bash", actual).Output()
+	if err != nil {
+		t.Skipf("bash can't expand prompts: %v", err)
+	}
+	assertOutput(t, branch, string(out))
+	if _, err := os.Stat(path.Join(dir, "x")); err == nil {
+		t.Errorf("Expected the branch name not to be run")
+	}
+}
+
+func TestShellSet(t *testing.T) {
+	for _, name := range []string{"plain", "zsh", "bash", "readline", "fish"} {
+		var s Shell
+		if err := s.Set(name); err != nil {
+			t.Errorf("Set(%q): unexpected error: %v", name, err)
+			continue
+		}
+		assertString(t, "Shell", name, s.String())
+	}
+
+	var s Shell
+	if err := s.Set("tcsh"); err == nil {
+		t.Errorf("Expected error for unknown shell")
+	}
+}
+
+func TestPrinterCleanDirty(t *testing.T) {
+	format := "%h[ ✔%{clean}][ ✗%{dirty}][ %{changed}]"
+	tests := []struct {
+		name     string
+		status   *GitStatus
+		expected string
+	}{
+		{
+			name:     "clean",
+			status:   &GitStatus{Branch: "master"},
+			expected: "master ✔",
+		},
+		{
+			name:     "dirty",
+			status:   &GitStatus{Branch: "master", Staged: 1, Modified: 1, Changed: 1},
+			expected: "master ✗ 1",
+		},
+		{
+			name:     "timed out",
+			status:   &GitStatus{Branch: "master", TimedOut: true},
+			expected: "master",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, _ := Print(test.status, format)
+			assertOutput(t, test.expected, actual)
+		})
+	}
+
+	actual, _ := Print(all, "[?{clean}✔|✗]")
+	assertOutput(t, "✗", actual)
+}
+
+func TestPrinterConditions(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		expected string
+		width    int
+	}{
+		{
+			name:     "true",
+			format:   "[?{behind > 3}#r↓%b]",
+			expected: "\x1b[31m↓5\x1b[0m",
+			width:    2,
+		},
+		{
+			name:     "false",
+			format:   "%h[?{behind > 10}#r↓%b]",
+			expected: "master",
+			width:    6,
+		},
+		{
+			name:     "else",
+			format:   "[?{behind > 10}far|near]",
+			expected: "near",
+			width:    4,
+		},
+		{
+			name:     "shows zero",
+			format:   "[?{untracked == 0}u%u]",
+			expected: "u0",
+			width:    2,
+		},
+		{
+			name:     "else when hidden",
+			format:   "%h[? %u| clean]",
+			expected: "master clean",
+			width:    12,
+		},
+		{
+			name:     "then when visible",
+			format:   "%h[? %m| clean]",
+			expected: "master 1",
+			width:    8,
+		},
+		{
+			name:     "and before or",
+			format:   "[?{ahead == 4 || untracked && behind == 0}y|n]",
+			expected: "y",
+			width:    1,
+		},
+		{
+			name:     "not before comparison",
+			format:   "[?{!untracked && conflicts >= 3}y|n]",
+			expected: "y",
+			width:    1,
+		},
+		{
+			name:     "parentheses",
+			format:   "[?{!(ahead > 3) || (stashes != 6)}y|n]",
+			expected: "n",
+			width:    1,
+		},
+		{
+			name:     "counts",
+			format:   "[?{index.added > 0}y|n][?{index.added <= 0}y|n]",
+			expected: "ny",
+			width:    2,
+		},
+		{
+			name:     "invalid condition",
+			format:   "[?{bogus > 1}y|n]",
+			expected: "n",
+			width:    1,
+		},
+		{
+			name:     "nested groups",
+			format:   "[?{ahead}[ a%a][ u%u]|x]",
+			expected: " a4",
+			width:    3,
+		},
+		{
+			name:     "nested condition",
+			format:   "[?{ahead}a[?{behind < 5}<|>]]",
+			expected: "a>",
+			width:    2,
+		},
+		{
+			name:     "pipe in nested group",
+			format:   "[?{ahead}[a|b]]",
+			expected: "a|b",
+			width:    3,
+		},
+		{
+			name:     "second pipe",
+			format:   "[?{0}a|b|c]",
+			expected: "b|c",
+			width:    3,
+		},
+		{
+			name:     "pipe outside",
+			format:   "a|b[c|d]",
+			expected: "a|bc|d",
+			width:    6,
+		},
+		{
+			name:     "escaped",
+			format:   "[\\?x]",
+			expected: "?x",
+			width:    2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, w := Print(all, test.format)
+			assertOutput(t, test.expected, actual)
+			assertWidth(t, test.width, w)
+		})
+	}
+}
+
 func TestPrinterNonMatching(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -250,6 +986,78 @@ func TestPrinterNonMatching(t *testing.T) {
 			expected: "A@",
 			width:    2,
 		},
+		{
+			name:     "unbalanced ]",
+			format:   "A]",
+			expected: "A]",
+			width:    2,
+		},
+		{
+			name:     "unbalanced }",
+			format:   "[A}]",
+			expected: "A}",
+			width:    2,
+		},
+		{
+			name:     "unclosed group",
+			format:   "#rA[B%h",
+			expected: "\x1b[31mA[Bmaster\x1b[0m",
+			width:    9,
+		},
+		{
+			name:     "unclosed nested groups",
+			format:   "[[[A",
+			expected: "[[[A",
+			width:    4,
+		},
+		{
+			name:     "unclosed conditional group",
+			format:   "[?%h|B",
+			expected: "[?master|B",
+			width:    10,
+		},
+		{
+			name:     "unclosed segment",
+			format:   "A#[B",
+			expected: "A#[B",
+			width:    4,
+		},
+		{
+			name:     "unclosed group around segment",
+			format:   "[A#[%h]",
+			expected: "[Amaster",
+			width:    8,
+		},
+		{
+			name:     "brace in group",
+			format:   "[{%h]",
+			expected: "{master",
+			width:    7,
+		},
+		{
+			name:     "braces in text",
+			format:   "A{ %h",
+			expected: "A{ master",
+			width:    9,
+		},
+		{
+			name:     "braces around data",
+			format:   "{%h} a{b}c",
+			expected: "{master} a{b}c",
+			width:    14,
+		},
+		{
+			name:     "caret",
+			format:   "^b %h",
+			expected: "^b master",
+			width:    9,
+		},
+		{
+			name:     "unclosed conditional group with condition",
+			format:   "[?{behind > 10} a",
+			expected: "[?{behind > 10} a",
+			width:    17,
+		},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,443 @@
+package gitprompt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/akupila/gitprompt/internal/gitconfig"
+)
+
+// errUnsupported is returned by the native reader when the repository uses a
+// feature it can't read. The caller should fall back to running git.
+var errUnsupported = errors.New("repository format not supported")
+
+// repository is a git repository found on disk.
+type repository struct {
+	// workTree is the top level directory of the working tree.
+	workTree string
+	// gitDir contains the files specific to the working tree, such as HEAD
+	// and the index.
+	gitDir string
+	// commonDir contains the files shared between working trees, such as
+	// refs and objects. Same as gitDir unless this is a linked working tree.
+	commonDir string
+
+	cfg *gitconfig.Config
+}
+
+// findRepository finds the repository dir is part of by looking for .git in
+// dir and its parents. Returns nil if dir is not in a repository.
+func findRepository(dir string) (*repository, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		fi, err := os.Stat(dotGit)
+		if err == nil {
+			return openRepository(dir, dotGit, fi)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+func openRepository(workTree, dotGit string, fi os.FileInfo) (*repository, error) {
+	gitDir := dotGit
+	if !fi.IsDir() {
+		// Linked working trees and submodules have a .git file pointing to
+		// the actual git dir.
+		b, err := ioutil.ReadFile(dotGit)
+		if err != nil {
+			return nil, err
+		}
+		line := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(line, "gitdir: ") {
+			return nil, errUnsupported
+		}
+		gitDir = strings.TrimPrefix(line, "gitdir: ")
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(workTree, gitDir)
+		}
+	}
+
+	commonDir := gitDir
+	if b, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(b))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+	}
+
+	return &repository{
+		workTree:  workTree,
+		gitDir:    gitDir,
+		commonDir: commonDir,
+	}, nil
+}
+
+// head returns the branch HEAD points to and the sha it resolves to. The
+// branch is empty if HEAD is detached and the sha is empty if the branch has
+// no commits yet.
+func (r *repository) head() (string, string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(r.gitDir, "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+	head := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(head, "ref: ") {
+		return "", head, nil
+	}
+	ref := strings.TrimPrefix(head, "ref: ")
+	sha, err := r.resolveRef(ref)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), sha, nil
+}
+
+// resolveRef returns the sha the ref points to, following symbolic refs.
+// Returns an empty string if the ref does not exist.
+func (r *repository) resolveRef(ref string) (string, error) {
+	for i := 0; i < 5; i++ {
+		b, err := ioutil.ReadFile(filepath.Join(r.commonDir, filepath.FromSlash(ref)))
+		if os.IsNotExist(err) {
+			return r.packedRef(ref)
+		}
+		if err != nil {
+			return "", err
+		}
+		v := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(v, "ref: ") {
+			return v, nil
+		}
+		ref = strings.TrimPrefix(v, "ref: ")
+	}
+	return "", errors.New("too many levels of symbolic refs")
+}
+
+func (r *repository) packedRef(ref string) (string, error) {
+	f, err := os.Open(filepath.Join(r.commonDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	suffix := []byte(" " + ref)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		if bytes.HasSuffix(line, suffix) {
+			return string(line[:len(line)-len(suffix)]), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// config reads the repository's config file.
+func (r *repository) config() (*gitconfig.Config, error) {
+	if r.cfg == nil {
+		c, err := gitconfig.ReadFile(filepath.Join(r.commonDir, "config"))
+		if err != nil {
+			return nil, err
+		}
+		r.cfg = c
+	}
+	return r.cfg, nil
+}
+
+// configValue returns the value of the key in the repository's config or, if
+// it's not set there, in the user's or the system's config. Returns
+// errUnsupported if a file included with includeIf sets the key, as the
+// conditions are not evaluated.
+func (r *repository) configValue(key string) (string, bool, error) {
+	files := append([]string{filepath.Join(r.commonDir, "config")}, globalConfigFiles()...)
+	for i, file := range files {
+		var c *gitconfig.Config
+		var err error
+		if i == 0 {
+			c, err = r.config()
+		} else {
+			c, err = gitconfig.ReadFile(file)
+		}
+		if err != nil {
+			return "", false, err
+		}
+		for _, cond := range c.Subsections("includeif") {
+			include, ok := c.Get("includeif." + cond + ".path")
+			if !ok {
+				continue
+			}
+			ic, err := gitconfig.ReadFile(includePath(include, file))
+			if err != nil {
+				return "", false, err
+			}
+			if _, ok := ic.Get(key); ok {
+				return "", false, errUnsupported
+			}
+		}
+		if v, ok := c.Get(key); ok {
+			return v, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// globalConfigFiles returns the user's and the system's git config files,
+// highest precedence first.
+func globalConfigFiles() []string {
+	var files []string
+	if file := os.Getenv("GIT_CONFIG_GLOBAL"); file != "" {
+		files = append(files, file)
+	} else {
+		home, _ := os.UserHomeDir()
+		if home != "" {
+			files = append(files, filepath.Join(home, ".gitconfig"))
+		}
+		dir := os.Getenv("XDG_CONFIG_HOME")
+		if dir == "" && home != "" {
+			dir = filepath.Join(home, ".config")
+		}
+		if dir != "" {
+			files = append(files, filepath.Join(dir, "git", "config"))
+		}
+	}
+	if os.Getenv("GIT_CONFIG_NOSYSTEM") == "" {
+		file := os.Getenv("GIT_CONFIG_SYSTEM")
+		if file == "" {
+			file = "/etc/gitconfig"
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// includePath returns the path of a file included from the config file,
+// which is relative to the including file.
+func includePath(include, file string) string {
+	include = expandHome(include)
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(filepath.Dir(file), include)
+	}
+	return include
+}
+
+// expandHome replaces a leading ~/ in the path with the home directory.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+// RepoConfig returns the keys in the gitprompt section of the config of the
+// repository dir is part of, such as "format" for gitprompt.format. Returns
+// nil if dir is not part of a git repository.
+func RepoConfig(dir string) (map[string]string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	repo, err := findRepository(dir)
+	if err == errUnsupported {
+		return nil, nil
+	}
+	if repo == nil || err != nil {
+		return nil, err
+	}
+	c, err := repo.config()
+	if err != nil {
+		return nil, err
+	}
+	return c.Section("gitprompt"), nil
+}
+
+// RepoPaths returns the top level directory of the working tree and the git
+// dir of the repository dir is part of, such as /src/repo and /src/repo/.git.
+// Both are empty if dir is not part of a git repository.
+func RepoPaths(dir string) (string, string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	repo, err := findRepository(dir)
+	if repo == nil || err != nil {
+		return "", "", err
+	}
+	return repo.workTree, repo.gitDir, nil
+}
+
+// checkFormat returns errUnsupported if the repository uses extensions the
+// native reader doesn't understand.
+func (r *repository) checkFormat() error {
+	c, err := r.config()
+	if err != nil {
+		return err
+	}
+	if f, ok := c.Get("extensions.objectformat"); ok && strings.ToLower(f) != "sha1" {
+		return errUnsupported
+	}
+	return nil
+}
+
+// upstream returns the short name of the branch's upstream, such as
+// origin/master, and whether the upstream branch exists. The name is empty
+// if no upstream is configured.
+func (r *repository) upstream(branch string) (string, bool, error) {
+	name, ref, err := r.upstreamRef(branch)
+	if ref == "" || err != nil {
+		return "", false, err
+	}
+	sha, err := r.resolveRef(ref)
+	if err != nil {
+		return "", false, err
+	}
+	return name, sha != "", nil
+}
+
+// upstreamRef returns the name of the branch's upstream, such as
+// origin/master, and the ref it's read from. Both are empty if no upstream is
+// configured.
+func (r *repository) upstreamRef(branch string) (string, string, error) {
+	c, err := r.config()
+	if err != nil {
+		return "", "", err
+	}
+	remote, ok := c.Get("branch." + branch + ".remote")
+	if !ok {
+		return "", "", nil
+	}
+	merge, ok := c.Get("branch." + branch + ".merge")
+	if !ok {
+		return "", "", nil
+	}
+	name := strings.TrimPrefix(merge, "refs/heads/")
+	ref := merge
+	if remote != "." {
+		ref = "refs/remotes/" + remote + "/" + name
+		name = remote + "/" + name
+	}
+	return name, ref, nil
+}
+
+// RefState describes the refs the status depends on: the branch and the sha
+// HEAD points to, the upstream and its sha, and the stash. It changes when a
+// commit, reset, fetch, push or stash moves them, and can be used to tell if
+// a cached status is stale. Returns an empty string if dir is not part of a
+// git repository.
+func RefState(dir string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	repo, err := findRepository(dir)
+	if repo == nil || err != nil {
+		return "", err
+	}
+	branch, sha, err := repo.head()
+	if err != nil {
+		return "", err
+	}
+	var upstream, upstreamSha string
+	if branch != "" {
+		var ref string
+		if upstream, ref, err = repo.upstreamRef(branch); err != nil {
+			return "", err
+		}
+		if ref != "" {
+			if upstreamSha, err = repo.resolveRef(ref); err != nil {
+				return "", err
+			}
+		}
+	}
+	stash, err := repo.resolveRef("refs/stash")
+	if err != nil {
+		return "", err
+	}
+	stashes, err := repo.stashes()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s %s %s %d", branch, sha, upstream, upstreamSha, stash, stashes), nil
+}
+
+// stashes returns the number of entries in the stash.
+func (r *repository) stashes() (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(r.commonDir, "logs", "refs", "stash"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return bytes.Count(b, []byte("\n")), nil
+}
+
+// WorkTreeState describes the files in the working tree git tracks: the size,
+// mode and modification time of each file in the index, and the modification
+// time of the directories they're in. It changes when a tracked file is
+// edited, removed or replaced, or a file is added next to one, and can be
+// used together with RefState to tell if a cached status is stale. Returns an
+// empty string if dir is not part of a git repository.
+func WorkTreeState(dir string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	repo, err := findRepository(dir)
+	if repo == nil || err != nil {
+		return "", err
+	}
+	idx, err := readIndex(filepath.Join(repo.gitDir, "index"))
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	stat := func(path string) {
+		fi, err := os.Lstat(filepath.Join(repo.workTree, filepath.FromSlash(path)))
+		if err != nil {
+			fmt.Fprintf(h, "%s -\n", path)
+			return
+		}
+		fmt.Fprintf(h, "%s %d %o %d\n", path, fi.Size(), fi.Mode(), fi.ModTime().UnixNano())
+	}
+	dirs := map[string]bool{"": true}
+	stat("")
+	for _, e := range idx.entries {
+		stat(e.path)
+		for d := pathDir(e.path); !dirs[d]; d = pathDir(d) {
+			dirs[d] = true
+			stat(d)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pathDir returns the directory of the slash separated path relative to the
+// top level directory, "" for files at the top level.
+func pathDir(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
@@ -0,0 +1,93 @@
+package gitprompt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Shell is the shell the output is printed for. Shells need to know which
+// parts of the prompt are escape codes so they can calculate its width, and
+// some treat characters in the prompt as special.
+type Shell string
+
+// Shells that output can be printed for.
+const (
+	// ShellPlain prints escape codes as is. This is the zero value.
+	ShellPlain Shell = ""
+	// ShellZsh wraps escape codes in %{ %} and escapes % in text, for
+	// $(gitprompt) in PROMPT with the PROMPT_SUBST option. The output must
+	// not be assigned to PROMPT itself, as zsh would then run any $( ) or
+	// backticks in branch names.
+	ShellZsh Shell = "zsh"
+	// ShellBash wraps escape codes in \[ \] and escapes \, $, ` and ! in
+	// text, for PS1 set in PROMPT_COMMAND with the promptvars option, which
+	// is on by default.
+	ShellBash Shell = "bash"
+	// ShellReadline wraps escape codes in \001 \002, which readline uses to
+	// mark invisible characters. This works for $(gitprompt) in bash's PS1.
+	ShellReadline Shell = "readline"
+	// ShellFish prints escape codes as is, fish calculates the width of the
+	// prompt by itself.
+	ShellFish Shell = "fish"
+)
+
+var shells = []Shell{ShellZsh, ShellBash, ShellReadline, ShellFish}
+
+// Set sets the shell by name, so it can be used as a flag.Value. "plain" is
+// the same as the empty string.
+func (s *Shell) Set(name string) error {
+	if name == "" || name == "plain" {
+		*s = ShellPlain
+		return nil
+	}
+	for _, sh := range shells {
+		if string(sh) == name {
+			*s = sh
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown shell %q", name)
+}
+
+func (s *Shell) String() string {
+	if *s == ShellPlain {
+		return "plain"
+	}
+	return string(*s)
+}
+
+// wrap returns the strings to print before and after an escape code.
+func (s Shell) wrap() (string, string) {
+	switch s {
+	case ShellZsh:
+		return "%{", "%}"
+	case ShellBash:
+		return `\[`, `\]`
+	case ShellReadline:
+		return "\x01", "\x02"
+	}
+	return "", ""
+}
+
+// escape escapes characters in text that the shell would otherwise interpret.
+func (s Shell) escape(text string) string {
+	switch s {
+	case ShellZsh:
+		return strings.Replace(text, "%", "%%", -1)
+	case ShellBash:
+		return bashEscaper.Replace(text)
+	}
+	return text
+}
+
+// bashEscaper escapes text in PS1. bash decodes backslash escapes such as \\
+// first and then expands $( ), backticks and variables, so \ and the
+// characters that start an expansion are escaped for both steps. ! is the
+// history number in POSIX mode, written in octal it's the same in both
+// modes.
+var bashEscaper = strings.NewReplacer(
+	`\`, `\\\\`,
+	`$`, `\\$`,
+	"`", "\\`",
+	`!`, `\041`,
+)
@@ -0,0 +1,74 @@
+package gitprompt
+
+import (
+	"context"
+	"fmt"
+)
+
+// StatusSource provides the status of a git repository.
+type StatusSource interface {
+	// Status returns the status of the repository, or nil if there is no
+	// repository. If the context is done before the status is known, the
+	// context's error is returned.
+	Status(ctx context.Context) (*GitStatus, error)
+}
+
+// UntrackedMode is how untracked files are found, like the
+// --untracked-files option of git status.
+type UntrackedMode string
+
+// Modes for finding untracked files.
+const (
+	// UntrackedNormal counts files in untracked directories as one, shown
+	// as the directory. This is the zero value.
+	UntrackedNormal UntrackedMode = ""
+	// UntrackedNo doesn't look for untracked files, which is faster in
+	// large working trees.
+	UntrackedNo UntrackedMode = "no"
+	// UntrackedAll counts each file in untracked directories.
+	UntrackedAll UntrackedMode = "all"
+)
+
+// Set sets the mode by name, so it can be used as a flag.Value. "normal" is
+// the same as the empty string.
+func (m *UntrackedMode) Set(name string) error {
+	switch name {
+	case "", "normal":
+		*m = UntrackedNormal
+	case string(UntrackedNo), string(UntrackedAll):
+		*m = UntrackedMode(name)
+	default:
+		return fmt.Errorf("unknown untracked mode %q", name)
+	}
+	return nil
+}
+
+func (m *UntrackedMode) String() string {
+	if *m == UntrackedNormal {
+		return "normal"
+	}
+	return string(*m)
+}
+
+// StatusFunc is a function that implements StatusSource.
+type StatusFunc func(ctx context.Context) (*GitStatus, error)
+
+// Status implements StatusSource by calling f.
+func (f StatusFunc) Status(ctx context.Context) (*GitStatus, error) {
+	return f(ctx)
+}
+
+// ParseWith gets the status from the source. If src is nil, the status is
+// parsed from git status, like Parse.
+func ParseWith(src StatusSource) (*GitStatus, error) {
+	return ParseContext(context.Background(), src)
+}
+
+// ParseContext gets the status from the source, giving up when the context
+// is done. If src is nil, the status is parsed from git status, like Parse.
+func ParseContext(ctx context.Context, src StatusSource) (*GitStatus, error) {
+	if src == nil {
+		src = ExecSource{}
+	}
+	return src.Status(ctx)
+}
@@ -0,0 +1,521 @@
+package gitprompt
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Template is a compiled format. It can be rendered any number of times, also
+// concurrently, without parsing the format again.
+type Template struct {
+	nodes []node
+}
+
+// Compile parses the format into a template.
+//
+// Print prints anything in the format it doesn't understand as is. Compile
+// instead returns a *FormatError for unknown tokens, unbalanced brackets and
+// invalid conditions.
+func Compile(format string) (*Template, error) {
+	c := compiler{in: []rune(format), strict: true}
+	nodes, _ := c.parse(scopeRoot, 0)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &Template{nodes: nodes}, nil
+}
+
+// compile parses the format into a template the way Print does, without
+// errors.
+func compile(format string) *Template {
+	c := compiler{in: []rune(format)}
+	nodes, _ := c.parse(scopeRoot, 0)
+	return &Template{nodes: nodes}
+}
+
+// FormatError is returned by Compile if the format is invalid.
+type FormatError struct {
+	// Format is the invalid format.
+	Format string
+	// Column is the position of the error in the format, counted in runes
+	// starting from 1.
+	Column int
+	// Reason describes what is wrong.
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("format: column %d: %s", e.Column, e.Reason)
+}
+
+// Caret returns the format and a line below it with a caret pointing at the
+// error.
+func (e *FormatError) Caret() string {
+	var b strings.Builder
+	b.WriteString(e.Format)
+	b.WriteString("\n")
+	for i, r := range []rune(e.Format) {
+		if i >= e.Column-1 {
+			break
+		}
+		if r == '\t' {
+			// Keep tabs so the caret lines up however wide they are.
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteString(strings.Repeat(" ", runeWidth(r)))
+	}
+	b.WriteString("^")
+	return b.String()
+}
+
+// Render prints the status with the template.
+//
+// The integer returned is the print width of the string.
+func (t *Template) Render(s *GitStatus) (string, int) {
+	return (&Printer{}).Render(t, s)
+}
+
+// Render prints the status with the template.
+//
+// The integer returned is the print width of the string.
+func (p *Printer) Render(t *Template, s *GitStatus) (string, int) {
+	if s == nil {
+		return "", 0
+	}
+
+	root := &group{printer: p}
+	root.format.shell = p.Shell
+	renderNodes(root, s, t.nodes)
+
+	root.format.clearColor()
+	root.format.clearBackground()
+	root.format.clearAttributes()
+	root.separate(root.format.bg, false)
+	root.format.printANSI(&root.buf)
+
+	return root.buf.String(), root.width
+}
+
+// node is a part of a compiled format.
+type node interface {
+	render(g *group, s *GitStatus)
+}
+
+func renderNodes(g *group, s *GitStatus, nodes []node) {
+	for _, n := range nodes {
+		n.render(g, s)
+	}
+}
+
+// textNode is text printed as is.
+type textNode string
+
+func (n textNode) render(g *group, s *GitStatus) {
+	for _, r := range n {
+		g.addRune(r)
+	}
+}
+
+// formatNode changes the format, such as the color.
+type formatNode func(f *formatter)
+
+func (n formatNode) render(g *group, s *GitStatus) {
+	n(&g.format)
+}
+
+// dataNode is a %x data token.
+type dataNode rune
+
+func (n dataNode) render(g *group, s *GitStatus) {
+	setData(g, s, rune(n))
+}
+
+// namedNode is a %{name} data token.
+type namedNode string
+
+func (n namedNode) render(g *group, s *GitStatus) {
+	setNamedData(g, s, string(n))
+}
+
+// groupNode is a group or a segment.
+type groupNode struct {
+	segment bool
+	nodes   []node
+}
+
+func (n *groupNode) render(g *group, s *GitStatus) {
+	c := g.open(n.segment)
+	renderNodes(c, s, n.nodes)
+	c.close()
+}
+
+// condNode is a conditional group.
+type condNode struct {
+	// cond is the condition, nil if there is none or it's invalid. hasCond
+	// is set if the group has a condition.
+	cond    condition
+	hasCond bool
+
+	then    []node
+	els     []node
+	hasElse bool
+}
+
+// render prints the branch that is chosen in place of the conditional group.
+//
+// With a condition, the then branch is chosen if it's true and the else
+// branch otherwise. Without a condition, the then branch is chosen if it
+// would be visible as a group.
+func (n *condNode) render(g *group, s *GitStatus) {
+	c := g.open(false)
+	then := c.open(false)
+	renderNodes(then, s, n.then)
+
+	var ok bool
+	if n.hasCond {
+		ok = n.cond != nil && n.cond.eval(s) != 0
+	} else {
+		ok = then.visible()
+	}
+
+	chosen := then
+	if !ok {
+		if !n.hasElse {
+			return
+		}
+		chosen = c.open(false)
+		renderNodes(chosen, s, n.els)
+	}
+	chosen.parent = g
+	chosen.show = true
+	chosen.close()
+}
+
+// scope is what the format being compiled is in.
+type scope uint8
+
+const (
+	scopeRoot scope = iota
+	scopeGroup
+	scopeSegment
+	scopeThen // then branch of a conditional group
+	scopeElse // else branch of a conditional group
+)
+
+type compiler struct {
+	in  []rune
+	pos int
+
+	// strict is set to return errors instead of compiling the format the way
+	// Print does. err is the first error.
+	strict bool
+	err    error
+
+	// unclosed holds the rune indexes of the [ and #[ that are not closed, so
+	// they're only parsed once.
+	unclosed map[int]bool
+}
+
+// fail sets the error at the rune index pos if it's the first one.
+func (c *compiler) fail(pos int, format string, args ...interface{}) {
+	if !c.strict || c.err != nil {
+		return
+	}
+	c.err = &FormatError{
+		Format: string(c.in),
+		Column: pos + 1,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func (c *compiler) next() (rune, bool) {
+	if c.pos >= len(c.in) {
+		return 0, false
+	}
+	ch := c.in[c.pos]
+	c.pos++
+	return ch, true
+}
+
+// peek returns true and skips the next rune if it's ch.
+func (c *compiler) peek(ch rune) bool {
+	if c.pos < len(c.in) && c.in[c.pos] == ch {
+		c.pos++
+		return true
+	}
+	return false
+}
+
+// name reads the name of a {name} after the opening brace, and returns false
+// if the format ends before the closing brace.
+func (c *compiler) name() (string, bool) {
+	start := c.pos
+	for ; c.pos < len(c.in); c.pos++ {
+		if c.in[c.pos] == tNameCl {
+			name := string(c.in[start:c.pos])
+			c.pos++
+			return name, true
+		}
+	}
+	return string(c.in[start:]), false
+}
+
+// parse parses the format until the end of the scope, opened at the rune
+// index open, and returns the nodes and the rune that ended it, or 0 if the
+// format ended. A [ or #[ that's not closed is printed as text.
+func (c *compiler) parse(sc scope, open int) ([]node, rune) {
+	var nodes []node
+	var text []rune
+	add := func(n node) {
+		if len(text) > 0 {
+			nodes = append(nodes, textNode(text))
+			text = text[:0]
+		}
+		nodes = append(nodes, n)
+	}
+	end := func(ch rune) ([]node, rune) {
+		if len(text) > 0 {
+			nodes = append(nodes, textNode(text))
+		}
+		return nodes, ch
+	}
+
+	for {
+		ch, ok := c.next()
+		if !ok {
+			if sc == scopeSegment {
+				c.fail(open, "unclosed %c%c", tColor, tGroupOp)
+			} else if sc != scopeRoot {
+				c.fail(open, "unclosed %c", c.in[open])
+			}
+			return end(0)
+		}
+		pos := c.pos - 1
+		switch ch {
+		case tEsc:
+			if ch, ok = c.next(); ok {
+				text = append(text, ch)
+			} else {
+				c.fail(pos, "unexpected end of format after %c", tEsc)
+			}
+		case tColor, tAttribute, tData:
+			if ch == tColor && c.peek(tGroupOp) {
+				if n := c.group(pos, true); n != nil {
+					add(n)
+					continue
+				}
+				// The [ is parsed again as a group.
+				text = append(text, ch)
+				continue
+			}
+			if ch == tColor && c.peek(tBg) {
+				ch = tBg
+			}
+			n, literal := c.token(ch)
+			if n == nil {
+				text = append(text, []rune(literal)...)
+				continue
+			}
+			add(n)
+		case tGroupOp:
+			if n := c.group(pos, false); n != nil {
+				add(n)
+				continue
+			}
+			text = append(text, ch)
+		case tElse:
+			if sc != scopeThen {
+				text = append(text, ch)
+				continue
+			}
+			return end(ch)
+		case tGroupCl:
+			if sc == scopeRoot {
+				c.fail(pos, "unexpected %c", ch)
+				text = append(text, ch)
+				continue
+			}
+			return end(ch)
+		default:
+			text = append(text, ch)
+		}
+	}
+}
+
+// group parses the group or segment opened at the rune index open, after the
+// [ or #[. If it's not closed, it returns nil and the [ or #[ is printed as
+// text.
+func (c *compiler) group(open int, segment bool) node {
+	if c.unclosed[open] {
+		return nil
+	}
+	var n node
+	if segment {
+		if nodes, closed := c.parse(scopeSegment, open); closed != 0 {
+			n = &groupNode{segment: true, nodes: nodes}
+		}
+	} else if c.peek(tCond) {
+		if cond, ok := c.cond(open); ok {
+			n = cond
+		}
+	} else if nodes, closed := c.parse(scopeGroup, open); closed != 0 {
+		n = &groupNode{nodes: nodes}
+	}
+	if n == nil {
+		c.backtrack(open)
+	}
+	return n
+}
+
+// backtrack continues after the [ or # of the #[ at the rune index open, which
+// is not closed.
+func (c *compiler) backtrack(open int) {
+	if c.unclosed == nil {
+		c.unclosed = make(map[int]bool)
+	}
+	c.unclosed[open] = true
+	c.pos = open + 1
+}
+
+// cond parses a conditional group opened at the rune index open, after [?,
+// and returns false if the format ends before it's closed.
+func (c *compiler) cond(open int) (*condNode, bool) {
+	n := &condNode{}
+	if c.peek(tNameOp) {
+		start := c.pos
+		name, ok := c.name()
+		if !ok {
+			c.fail(start-1, "unclosed condition")
+			return nil, false
+		}
+		var err error
+		n.cond, err = parseCondition(name)
+		if err, ok := err.(*conditionError); ok {
+			// The position in the condition is a byte offset.
+			c.fail(start+utf8.RuneCountInString(name[:err.pos]), "invalid condition: %s", err.reason)
+		}
+		n.hasCond = true
+	}
+	var end rune
+	n.then, end = c.parse(scopeThen, open)
+	if end == tElse {
+		n.hasElse = true
+		n.els, end = c.parse(scopeElse, open)
+	}
+	return n, end != 0
+}
+
+// token parses the token after the prefix. If it's not a valid token, the
+// node is nil and the token is returned to be printed as text.
+func (c *compiler) token(prefix rune) (node, string) {
+	lead := string(prefix)
+	if prefix == tBg {
+		// Background colors are written #^.
+		lead = string(tColor) + lead
+	}
+	pos := c.pos - utf8.RuneCountInString(lead)
+	ch, ok := c.next()
+	if !ok {
+		c.fail(pos, "unexpected end of format after %s", lead)
+		return nil, lead
+	}
+	if ch == tNameOp {
+		name, ok := c.name()
+		if !ok {
+			c.fail(pos, "unclosed %s%c", lead, tNameOp)
+			return nil, lead + string(tNameOp) + name
+		}
+		if n := namedToken(prefix, name); n != nil {
+			return n, ""
+		}
+		literal := lead + string(tNameOp) + name + string(tNameCl)
+		c.fail(pos, "unknown %s %s", tokenKinds[prefix], literal)
+		return nil, literal
+	}
+	if n := token(prefix, ch); n != nil {
+		return n, ""
+	}
+	literal := lead + string(ch)
+	c.fail(pos, "unknown %s %s", tokenKinds[prefix], literal)
+	return nil, literal
+}
+
+// tokenKinds describe the tokens after each prefix in errors.
+var tokenKinds = map[rune]string{
+	tData:      "data",
+	tColor:     "color",
+	tBg:        "background color",
+	tAttribute: "attribute",
+}
+
+// token returns the node for the token ch after the prefix, or nil if it's not
+// a valid token.
+func token(prefix, ch rune) node {
+	switch prefix {
+	case tData:
+		if isData(ch) {
+			return dataNode(ch)
+		}
+	case tColor:
+		if ch == tReset {
+			return formatNode((*formatter).clearColor)
+		}
+		if code, ok := colors[ch]; ok {
+			col := basicColor(code)
+			return formatNode(func(f *formatter) { f.setColor(col) })
+		}
+	case tBg:
+		if ch == tReset {
+			return formatNode((*formatter).clearBackground)
+		}
+		if code, ok := colors[ch]; ok {
+			col := basicColor(code)
+			return formatNode(func(f *formatter) { f.setBackground(col) })
+		}
+	case tAttribute:
+		switch ch {
+		case tReset:
+			return formatNode((*formatter).clearAttributes)
+		case 'u':
+			return formatNode(func(f *formatter) { f.setUnderline(underlineSingle) })
+		case 'U':
+			return formatNode(func(f *formatter) { f.setUnderline(noUnderline) })
+		}
+		if a, ok := attrs[ch]; ok {
+			return formatNode(func(f *formatter) { f.setAttribute(a) })
+		}
+		if a, ok := resetAttrs[ch]; ok {
+			return formatNode(func(f *formatter) { f.clearAttribute(a) })
+		}
+	}
+	return nil
+}
+
+// namedToken returns the node for the {name} token after the prefix, or nil if
+// it's not a valid token.
+func namedToken(prefix rune, name string) node {
+	switch prefix {
+	case tData:
+		if _, ok := values[name]; ok {
+			return namedNode(name)
+		}
+		if _, ok := flags[name]; ok {
+			return namedNode(name)
+		}
+	case tColor:
+		if col, ok := parseColor(name); ok {
+			return formatNode(func(f *formatter) { f.setColor(col) })
+		}
+	case tBg:
+		if col, ok := parseColor(name); ok {
+			return formatNode(func(f *formatter) { f.setBackground(col) })
+		}
+	case tAttribute:
+		if u, ok := underlines[name]; ok {
+			return formatNode(func(f *formatter) { f.setUnderline(u) })
+		}
+	}
+	return nil
+}
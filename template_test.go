@@ -0,0 +1,189 @@
+package gitprompt
+
+import (
+	"sync"
+	"testing"
+)
+
+// benchmarkFormat is the default format of the gitprompt command.
+const benchmarkFormat = "#B([@b#R%h][#Y %o[ %p]][#y ›%s][#m ↓%b][#m ↑%a][#r x%c][#g +%m][#y %u][#K …%t]#B) "
+
+func TestCompile(t *testing.T) {
+	formats := []string{
+		"",
+		"%h",
+		benchmarkFormat,
+		"%h[ %o[ %p]]",
+		"#r%h#_ @b%s@_ #^b%a#^_",
+		"#{196}%h #{ff8800}%s #^{22}%a @{curly}%b %{changed} %{clean}",
+		"#[#^b%h]#[#^g%s]#[#^g%a] [#[#^r%u]]",
+		"[?{ahead > 0}↑%a|=] [?[%u]|none] [?{behind}↓%b]",
+		"\\[%h\\] \\%s | \\} \\]",
+	}
+
+	for _, format := range formats {
+		t.Run(format, func(t *testing.T) {
+			tmpl, err := Compile(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, expectedWidth := Print(all, format)
+			actual, w := tmpl.Render(all)
+			assertOutput(t, expected, actual)
+			assertWidth(t, expectedWidth, w)
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		column int
+		reason string
+	}{
+		{"%h #x", 4, "unknown color #x"},
+		{"%z", 1, "unknown data %z"},
+		{"#^x", 1, "unknown background color #^x"},
+		{"@x", 1, "unknown attribute @x"},
+		{"#{nope}", 1, "unknown color #{nope}"},
+		{"%{nope}", 1, "unknown data %{nope}"},
+		{"@{wavy}", 1, "unknown attribute @{wavy}"},
+		{"%h #", 4, "unexpected end of format after #"},
+		{"%h \\", 4, "unexpected end of format after \\"},
+		{"%h %{changed", 4, "unclosed %{"},
+		{"%h]", 3, "unexpected ]"},
+		{"%h[ %s", 3, "unclosed ["},
+		{"%h[ %s[ %a]", 3, "unclosed ["},
+		{"%h{ %s]", 7, "unexpected ]"},
+		{"%h[ {%s", 3, "unclosed ["},
+		{"%h#[ %s", 3, "unclosed #["},
+		{"%h[ #[%s]", 3, "unclosed ["},
+		{"%h#^", 3, "unexpected end of format after #^"},
+		{"%h[?{ahead", 5, "unclosed condition"},
+		{"%h[?{ahead}%a", 3, "unclosed ["},
+		{"%h[?{ahead}%a|%b", 3, "unclosed ["},
+		{"%h[?{ahead >}%a]", 13, "invalid condition: unexpected end"},
+		{"%h[?{ahead > nope}%a]", 14, "invalid condition: unknown name nope"},
+		{"↑↑[?{ahead > 1 1}%a]", 16, `invalid condition: unexpected "1"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			_, err := Compile(test.format)
+			ferr, ok := err.(*FormatError)
+			if !ok {
+				t.Fatalf("Expected *FormatError, got %v", err)
+			}
+			assertString(t, "format", test.format, ferr.Format)
+			assertInt(t, "column", test.column, ferr.Column)
+			assertString(t, "reason", test.reason, ferr.Reason)
+		})
+	}
+}
+
+func TestFormatErrorCaret(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"%h #x", "%h #x\n   ^"},
+		{"✋🚚[%h", "✋🚚[%h\n    ^"},
+		{"\t#x", "\t#x\n\t^"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			_, err := Compile(test.format)
+			ferr, ok := err.(*FormatError)
+			if !ok {
+				t.Fatalf("Expected *FormatError, got %v", err)
+			}
+			assertString(t, "caret", test.expected, ferr.Caret())
+		})
+	}
+
+	err := &FormatError{Format: "%z", Column: 1, Reason: "unknown data %z"}
+	assertString(t, "error", "format: column 1: unknown data %z", err.Error())
+}
+
+func TestTemplateRender(t *testing.T) {
+	tmpl, err := Compile("%h[ ↑%a]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, w := tmpl.Render(&GitStatus{Branch: "master"})
+	assertOutput(t, "master", actual)
+	assertWidth(t, 6, w)
+
+	actual, w = tmpl.Render(&GitStatus{Branch: "dev", Ahead: 2})
+	assertOutput(t, "dev ↑2", actual)
+	assertWidth(t, 6, w)
+
+	actual, w = tmpl.Render(nil)
+	assertOutput(t, "", actual)
+	assertWidth(t, 0, w)
+}
+
+func TestTemplateConcurrent(t *testing.T) {
+	tmpl, err := Compile(benchmarkFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := Print(all, benchmarkFormat)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if actual, _ := tmpl.Render(all); actual != expected {
+					t.Errorf("Expected %q, got %q", expected, actual)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPrinterRender(t *testing.T) {
+	tmpl, err := Compile("#[#^b%h]#[#^g%s]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Printer{Separator: ">", ThinSeparator: "|", Shell: ShellZsh}
+	expected, expectedWidth := p.Print(all, "#[#^b%h]#[#^g%s]")
+	actual, w := p.Render(tmpl, all)
+	assertOutput(t, expected, actual)
+	assertWidth(t, expectedWidth, w)
+}
+
+func BenchmarkPrint(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Print(all, benchmarkFormat)
+	}
+}
+
+func BenchmarkCompile(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Compile(benchmarkFormat); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	tmpl, err := Compile(benchmarkFormat)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmpl.Render(all)
+	}
+}
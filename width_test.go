@@ -0,0 +1,43 @@
+package gitprompt
+
+import "testing"
+
+func TestWidthRangesSorted(t *testing.T) {
+	for name, ranges := range map[string][]widthRange{"wideRanges": wideRanges, "zeroWidth": zeroWidth} {
+		for i, r := range ranges {
+			if r.lo > r.hi {
+				t.Errorf("%s[%d]: %#x > %#x", name, i, r.lo, r.hi)
+			}
+			if i > 0 && ranges[i-1].hi >= r.lo {
+				t.Errorf("%s[%d]: %#x overlaps or is out of order", name, i, r.lo)
+			}
+		}
+	}
+}
+
+func TestRuneWidth(t *testing.T) {
+	tests := []struct {
+		r     rune
+		width int
+	}{
+		{'a', 1},
+		{'é', 1},
+		{'\t', 1},
+		{'\n', 0},
+		{'\u0301', 0}, // combining acute accent
+		{'\u200d', 0}, // zero width joiner
+		{'\ufe0f', 0}, // variation selector 16
+		{'\u00ad', 1}, // soft hyphen
+		{'機', 2},
+		{'ｱ', 1}, // halfwidth katakana
+		{'Ａ', 2}, // fullwidth A
+		{'🚚', 2},
+		{'⬆', 1},
+		{'\U00020000', 2},
+	}
+	for _, test := range tests {
+		if w := runeWidth(test.r); w != test.width {
+			t.Errorf("runeWidth(%q): expected %d, got %d", test.r, test.width, w)
+		}
+	}
+}